@@ -6,6 +6,7 @@ package cache
 import (
 	"archive/tar"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -14,61 +15,197 @@ import (
 // helper function to tar source directory to io.Writer w.
 func archive(src string, w io.Writer) error {
 
+	// absolute symlink targets are compared with the absolute src
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+
 	// ensure the src actually exists before trying to tar it
 	if _, err := os.Stat(src); err != nil {
 		return err
 	}
 
 	tw := tar.NewWriter(w)
-	defer tw.Close()
+
+	// names of the already archived files with multiple hard links
+	links := map[fileID]string{}
 
 	// walk path
-	return filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+	err = filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
 
 		// return on any error
 		if err != nil {
 			return err
 		}
 
+		// update the name to correctly reflect the desired destination when untaring
+		name, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+
+		// the source directory itself is the extraction target
+		if name == "." {
+			return nil
+		}
+
+		// sockets only live as long as the process serving them
+		if fi.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+
+		// resolve the symlink target, see linkname
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = linkname(src, file); err != nil {
+				return err
+			}
+
+			// restores reject symlinks pointing outside the directory
+			if !localLink(filepath.ToSlash(name), link) {
+				log.Printf("warning: skipping symlink <%s>, its target %s is outside the directory\n", file, link)
+				return nil
+			}
+		}
+
 		// create a new dir/file header
-		header, err := tar.FileInfoHeader(fi, fi.Name())
+		header, err := tar.FileInfoHeader(fi, link)
 		if err != nil {
 			return err
 		}
+		header.Name = filepath.ToSlash(name)
+		if fi.IsDir() {
+			header.Name += "/"
+		}
 
-		// update the name to correctly reflect the desired destination when untaring
-		header.Name = strings.TrimPrefix(strings.Replace(file, src, "", -1), string(filepath.Separator))
+		// archive the content of hard linked files only once
+		if id, ok := hardlink(fi); ok {
+			if first, ok := links[id]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+			} else {
+				links[id] = header.Name
+			}
+		}
 
 		// write the header
 		if err := tw.WriteHeader(header); err != nil {
 			return err
 		}
 
-		// return on directories since there will be no content to tar
-		if fi.Mode().IsDir() {
+		// return on headers without content
+		if header.Typeflag != tar.TypeReg {
 			return nil
 		}
 
-		// open files for taring
-		f, err := os.Open(file)
-		defer f.Close()
+		return copyFile(tw, file)
+	})
+	if err != nil {
+		return err
+	}
+
+	// flush the tar footer, the writer is left open on errors
+	return tw.Close()
+}
+
+// helper function to read the target of the symlink file in the absolute
+// src directory, see relativeLink.
+func linkname(src, file string) (string, error) {
+	target, err := os.Readlink(file)
+	if err != nil {
+		return "", err
+	}
+	return relativeLink(src, file, target)
+}
+
+// helper function to return the target of the symlink file in the absolute
+// src directory. Absolute targets inside src are made relative to the link,
+// so the link keeps working after the directory is restored somewhere else.
+func relativeLink(src, file, target string) (string, error) {
+	if !filepath.IsAbs(target) || !within(src, target) {
+		return filepath.ToSlash(target), nil
+	}
+
+	rel, err := filepath.Rel(filepath.Dir(file), target)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// helper function to copy the archive of the absolute src directory read
+// from io.Reader r to io.Writer w, with the symlinks handled like archive
+// does. It is used to filter the output of the tar binary.
+func rewriteLinks(w io.Writer, r io.Reader, src string) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return tw.Close()
+		}
 		if err != nil {
 			return err
 		}
-
-		// copy file data into tar writer
-		if _, err := io.Copy(tw, f); err != nil {
+		if header.Typeflag == tar.TypeSymlink {
+			file := filepath.Join(src, filepath.FromSlash(header.Name))
+			if header.Linkname, err = relativeLink(src, file, filepath.FromSlash(header.Linkname)); err != nil {
+				return err
+			}
+		}
+		if header.Typeflag == tar.TypeSymlink && !localLink(header.Name, header.Linkname) {
+			log.Printf("warning: skipping symlink <%s>, its target %s is outside the directory\n", header.Name, header.Linkname)
+			continue
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
 			return err
 		}
+	}
+}
 
-		return nil
-	})
+// helper function to copy the contents of file to io.Writer w.
+func copyFile(w io.Writer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
 }
 
 // helper function to untar io.Reader r to the destincation directory.
-func extract(dst string, r io.Reader) error {
+func extract(dst string, r io.Reader, opts Options) error {
 	tr := tar.NewReader(r)
 
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	v, err := newValidator(dst, opts)
+	if err != nil {
+		return err
+	}
+	dst = v.dst
+
+	// directory modes and times are restored last, read-only directories
+	// would block creating their content and creating it updates the times
+	var dirs []*tar.Header
+	defer func() {
+		for i := len(dirs) - 1; i >= 0; i-- {
+			target := filepath.Join(dst, dirs[i].Name)
+			os.Chmod(target, dirs[i].FileInfo().Mode().Perm())
+			os.Chtimes(target, dirs[i].ModTime, dirs[i].ModTime)
+		}
+	}()
+
 	for {
 		header, err := tr.Next()
 
@@ -87,36 +224,98 @@ func extract(dst string, r io.Reader) error {
 			continue
 		}
 
+		// reject anything that would escape the destination
+		if err := v.check(header); err != nil {
+			return err
+		}
+
 		// the target location where the dir/file should be created
 		target := filepath.Join(dst, header.Name)
-
-		// the following switch could also be done using fi.Mode(), not sure if there
-		// a benefit of using one vs. the other.
-		// fi := header.FileInfo()
+		mode := header.FileInfo().Mode()
 
 		// check the file type
 		switch header.Typeflag {
 
 		// if its a dir and it doesn't exist create it
 		case tar.TypeDir:
-			if _, err := os.Stat(target); err != nil {
-				if err := os.MkdirAll(target, 0755); err != nil {
-					return err
-				}
-			}
+			err = os.MkdirAll(target, 0755)
+			dirs = append(dirs, header)
 
 		// if it's a file create it
 		case tar.TypeReg:
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
-			if err != nil {
-				return err
-			}
-			defer f.Close()
+			err = create(target, func() error {
+				if err := writeFile(target, mode.Perm(), tr); err != nil {
+					return err
+				}
+				return os.Chtimes(target, header.ModTime, header.ModTime)
+			})
 
-			// copy over contents
-			if _, err := io.Copy(f, tr); err != nil {
-				return err
-			}
+		// symlinks are restored as is, their targets may not exist yet
+		case tar.TypeSymlink:
+			err = create(target, func() error {
+				return os.Symlink(filepath.FromSlash(header.Linkname), target)
+			})
+
+		// hard links point to a file extracted earlier in the archive
+		case tar.TypeLink:
+			err = create(target, func() error {
+				return os.Link(filepath.Join(dst, header.Linkname), target)
+			})
+
+		case tar.TypeFifo:
+			err = create(target, func() error {
+				return mkfifo(target, mode)
+			})
+
+		// devices need privileges we can't expect on the build agent
+		default:
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// helper function to replace target with the file created by fn. Any
+// existing non-directory file is removed first, so links are never followed
+// and existing hard links are not written through.
+func create(target string, fn func() error) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+		if err := os.Remove(target); err != nil {
+			return err
 		}
 	}
+	return fn()
+}
+
+// helper function to write the contents of io.Reader r to the file target.
+func writeFile(target string, mode os.FileMode, r io.Reader) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	// copy over contents
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// the umask may have masked the mode on creation
+	return os.Chmod(target, mode)
+}
+
+// helper function to check if path is inside the directory dir.
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
@@ -0,0 +1,29 @@
+//go:build !windows
+
+package cache
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID uniquely identifies a file on the host machine's file system.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// helper function to return the identity of a regular file that has more than
+// one hard link, so the links can be archived once.
+func hardlink(fi os.FileInfo) (fileID, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || !fi.Mode().IsRegular() || st.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// helper function to create a named pipe.
+func mkfifo(path string, mode os.FileMode) error {
+	return syscall.Mkfifo(path, uint32(mode.Perm()))
+}
@@ -0,0 +1,19 @@
+package cache
+
+import (
+	"errors"
+	"os"
+)
+
+// fileID uniquely identifies a file on the host machine's file system.
+type fileID struct{}
+
+// hard links are not detected on windows, every link is archived as a file.
+func hardlink(fi os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+// named pipes are not supported on windows.
+func mkfifo(path string, mode os.FileMode) error {
+	return errors.New("named pipes are not supported")
+}
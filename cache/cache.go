@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -17,8 +18,104 @@ type Cache interface {
 	Remove(string) error
 }
 
+// Exclusive is implemented by caches which can create an entry only if it
+// does not exist yet. It is the basis of locks shared by several builds.
+type Exclusive interface {
+	// Create writes the entry like Put, but fails with an error satisfying
+	// os.IsExist if the entry exists already.
+	Create(string, time.Duration, io.Reader) error
+}
+
+// AccessTime returns the time the cache entry described by fi was last read.
+// Caches record it by returning an os.FileInfo with an AccessTime method from
+// List, the modification time is used otherwise.
+func AccessTime(fi os.FileInfo) time.Time {
+	if a, ok := fi.(interface {
+		AccessTime() time.Time
+	}); ok {
+		return a.AccessTime()
+	}
+	return fi.ModTime()
+}
+
+// Engine identifies the implementation used to build and extract archives.
+type Engine string
+
+// Supported archive engines.
+const (
+	// GoEngine archives with the archive/tar package, see Rebuild and Restore.
+	GoEngine Engine = "go"
+
+	// TarEngine archives with the tar binary, see RebuildCmd and RestoreCmd.
+	TarEngine Engine = "tar"
+)
+
+// ParseEngine returns the Engine matching the given name. An empty name means
+// the Go engine.
+func ParseEngine(name string) (Engine, error) {
+	switch e := Engine(name); e {
+	case "", GoEngine:
+		return GoEngine, nil
+	case TarEngine:
+		return e, nil
+	default:
+		return "", fmt.Errorf("unsupported archive engine %q", name)
+	}
+}
+
+// Options defines how archives are written to and read from the cache.
+type Options struct {
+	// Compression is the algorithm used to compress new archives. Restores
+	// detect the compression of an archive automatically.
+	Compression Compression
+
+	// Level is the compression level, zero selects the algorithm default.
+	Level int
+
+	// MaxBytes limits the total size of the files restored from an archive,
+	// zero means no limit.
+	MaxBytes int64
+
+	// MaxFiles limits the number of entries restored from an archive, zero
+	// means no limit.
+	MaxFiles int
+
+	// TTL is the time after which new archives expire, zero means never.
+	TTL time.Duration
+}
+
 // Rebuild is a helper function that pushes the archived file to the cache.
-func Rebuild(c Cache, src, dst string) error {
+func Rebuild(c Cache, src, dst string, opts Options) error {
+	return put(c, dst, opts, func(w io.Writer) error {
+		return archive(src, w)
+	})
+}
+
+// Restore is a helper function that fetches the archived file from the cache
+// and restores to the host machine's file system. Entries escaping dst or
+// exceeding the limits in opts fail with an UnsafeArchiveError.
+func Restore(c Cache, src, dst string, opts Options) error {
+	rc, err := c.Get(src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	dr, err := decompress(rc)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	if err := extract(dst, dr, opts); err != nil {
+		return err
+	}
+	return drain(rc)
+}
+
+// helper function that streams the output of fn through the requested
+// compression to the cache.
+func put(c Cache, dst string, opts Options, fn func(io.Writer) error) error {
 	r, w := io.Pipe()
 	defer func() {
 		w.Close()
@@ -29,12 +126,12 @@ func Rebuild(c Cache, src, dst string) error {
 	c2 := make(chan error)
 
 	go func() {
-		c1 <- archive(src, w)
-		w.Close()
+		c1 <- write(w, opts, fn)
 	}()
 	go func() {
-		c2 <- c.Put(dst, 0, r)
-		r.Close()
+		err := c.Put(dst, opts.TTL, r)
+		r.CloseWithError(err)
+		c2 <- err
 	}()
 
 	err1 := <-c1
@@ -45,16 +142,22 @@ func Rebuild(c Cache, src, dst string) error {
 	return err2
 }
 
-// Restore is a helper function that fetches the archived file from the cache
-// and restores to the host machine's file system.
-func Restore(c Cache, src, dst string) error {
-	rc, err := c.Get(src)
+// helper function that compresses the output of fn to the pipe writer w. The
+// pipe is closed with the resulting error so the reader never blocks.
+func write(w *io.PipeWriter, opts Options, fn func(io.Writer) error) (err error) {
+	defer func() {
+		w.CloseWithError(err)
+	}()
+
+	cw, err := compress(w, opts.Compression, opts.Level)
 	if err != nil {
 		return err
 	}
-	defer rc.Close()
-
-	return extract(dst, rc)
+	if err := fn(cw); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
 }
 
 //
@@ -63,7 +166,7 @@ func Restore(c Cache, src, dst string) error {
 //
 
 // RebuildCmd is a helper function that pushes the archived file to the cache.
-func RebuildCmd(c Cache, src, dst string) (err error) {
+func RebuildCmd(c Cache, src, dst string, opts Options) (err error) {
 
 	src = filepath.Clean(src)
 	src, err = filepath.Abs(src)
@@ -71,60 +174,95 @@ func RebuildCmd(c Cache, src, dst string) (err error) {
 		return err
 	}
 
-	// create a temporary file for the archive
-	dir, err := ioutil.TempDir("", "")
-	if err != nil {
+	// ensure the src actually exists before trying to tar it
+	if _, err := os.Stat(src); err != nil {
 		return err
 	}
-	tar := filepath.Join(dir, "archive.tar")
 
-	// run archive command
-	cmd := exec.Command("tar", "-cf", tar, src)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return err
-	}
+	// stream the archive command output to the server, with the symlinks
+	// rewritten or skipped like the go engine does
+	return put(c, dst, opts, func(w io.Writer) error {
+		cmd := exec.Command("tar", "-cf", "-", "-C", src, ".")
+		cmd.Stderr = os.Stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return err
+		}
 
-	// upload file to server
-	f, err := os.Open(tar)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	return c.Put(dst, 0, f)
+		if err := rewriteLinks(w, stdout, src); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+
+		// read the padding after the end of the archive
+		if _, err := io.Copy(ioutil.Discard, stdout); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+		return cmd.Wait()
+	})
 }
 
 // RestoreCmd is a helper function that fetches the archived file from the cache
-// and restores to the host machine's file system.
-func RestoreCmd(c Cache, src, dst string) error {
+// and restores to the host machine's file system. The archive is validated
+// the same way as in Restore before it reaches the tar binary.
+func RestoreCmd(c Cache, src, dst string, opts Options) error {
 	rc, err := c.Get(src)
 	if err != nil {
 		return err
 	}
 	defer rc.Close()
 
-	// create temp file for archive
-	temp, err := ioutil.TempFile("", "")
+	dr, err := decompress(rc)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		temp.Close()
-		os.Remove(temp.Name())
-	}()
+	defer dr.Close()
 
-	// download archive to temp file
-	if _, err := io.Copy(temp, rc); err != nil {
+	if err := os.MkdirAll(dst, 0755); err != nil {
 		return err
 	}
 
-	// cleanup after ourself
-	temp.Close()
+	v, err := newValidator(dst, opts)
+	if err != nil {
+		return err
+	}
 
-	// run extraction command
-	cmd := exec.Command("tar", "-xf", temp.Name(), "-C", "/")
+	// stream the validated download to the extraction command
+	cmd := exec.Command("tar", "-xf", "-", "-C", dst)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	err = filter(stdin, dr, v)
+	if err == nil {
+		err = drain(rc)
+	}
+	if err != nil {
+		// stop the extraction before it sees the rest of the archive
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	stdin.Close()
+	return cmd.Wait()
+}
+
+// helper function to read the rest of the download r. The archive ends
+// before the stream does, caches verifying the download report a mismatch
+// only once they read all of it.
+func drain(r io.Reader) error {
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
 }
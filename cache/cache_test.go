@@ -1 +1,294 @@
 package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memCache is an in-memory implementation of the Cache.
+type memCache struct {
+	sync.Mutex
+	files map[string][]byte
+}
+
+func newMemCache() *memCache {
+	return &memCache{files: map[string][]byte{}}
+}
+
+func (c *memCache) List(root string) ([]os.FileInfo, error) {
+	return nil, nil
+}
+
+func (c *memCache) Get(p string) (io.ReadCloser, error) {
+	c.Lock()
+	defer c.Unlock()
+	b, ok := c.files[p]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (c *memCache) Put(p string, t time.Duration, src io.Reader) error {
+	b, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.files[p] = b
+	return nil
+}
+
+func (c *memCache) Remove(p string) error {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.files, p)
+	return nil
+}
+
+// helper function to create a temporary directory removed after the test.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// helper function to create the file name below dir with the given content.
+func writeTestFile(t *testing.T, dir, name, content string) {
+	p := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebuildRestore(t *testing.T) {
+	tests := []struct {
+		name    string
+		rebuild func(Cache, string, string, Options) error
+		restore func(Cache, string, string, Options) error
+		opts    Options
+	}{
+		{"go", Rebuild, Restore, Options{}},
+		{"go gzip", Rebuild, Restore, Options{Compression: Gzip}},
+		{"go zstd", Rebuild, Restore, Options{Compression: Zstd}},
+		{"tar", RebuildCmd, RestoreCmd, Options{}},
+		{"tar zstd", RebuildCmd, RestoreCmd, Options{Compression: Zstd}},
+		{"go to tar", Rebuild, RestoreCmd, Options{Compression: Gzip}},
+		{"tar to go", RebuildCmd, Restore, Options{Compression: Gzip}},
+	}
+
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar binary not found")
+	}
+
+	for _, tt := range tests {
+		src, dst := tempDir(t), tempDir(t)
+		writeTestFile(t, src, "a.txt", "a")
+		writeTestFile(t, src, "foo/bar/b.txt", "b")
+
+		c := newMemCache()
+		assert.NoError(t, tt.rebuild(c, src, "archive", tt.opts), tt.name)
+		assert.NoError(t, tt.restore(c, "archive", dst, Options{}), tt.name)
+
+		b, err := ioutil.ReadFile(filepath.Join(dst, "a.txt"))
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, "a", string(b), tt.name)
+
+		b, err = ioutil.ReadFile(filepath.Join(dst, "foo/bar/b.txt"))
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, "b", string(b), tt.name)
+	}
+}
+
+func TestRebuildMissingSource(t *testing.T) {
+	c := newMemCache()
+	assert.Error(t, Rebuild(c, "/does/not/exist", "archive", Options{}))
+	assert.Error(t, RebuildCmd(c, "/does/not/exist", "archive", Options{}))
+}
+
+func TestRoundTripLinks(t *testing.T) {
+	src, dst := tempDir(t), tempDir(t)
+	writeTestFile(t, src, "tool/bin.js", "#!/usr/bin/env node")
+	writeTestFile(t, src, "store/pkg/index.js", "module.exports = {}")
+	writeTestFile(t, src, "empty", "")
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, ".bin"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "empty_dir"), 0700))
+
+	// relative and absolute symlinks inside the directory
+	assert.NoError(t, os.Symlink("../tool/bin.js", filepath.Join(src, ".bin/tool")))
+	assert.NoError(t, os.Symlink(filepath.Join(src, "tool"), filepath.Join(src, ".bin/abs")))
+	assert.NoError(t, os.Symlink("missing", filepath.Join(src, "dangling")))
+
+	// hard links between directories
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "node_modules/pkg"), 0755))
+	assert.NoError(t, os.Link(filepath.Join(src, "store/pkg/index.js"), filepath.Join(src, "node_modules/pkg/index.js")))
+
+	// named pipe
+	assert.NoError(t, mkfifo(filepath.Join(src, "fifo"), 0600))
+
+	c := newMemCache()
+	assert.NoError(t, Rebuild(c, src, "archive", Options{}))
+	assert.NoError(t, Restore(c, "archive", dst, Options{}))
+
+	link, err := os.Readlink(filepath.Join(dst, ".bin/tool"))
+	assert.NoError(t, err)
+	assert.Equal(t, "../tool/bin.js", link)
+	b, err := ioutil.ReadFile(filepath.Join(dst, ".bin/tool"))
+	assert.NoError(t, err)
+	assert.Equal(t, "#!/usr/bin/env node", string(b))
+
+	link, err = os.Readlink(filepath.Join(dst, ".bin/abs"))
+	assert.NoError(t, err)
+	assert.Equal(t, "../tool", link)
+
+	link, err = os.Readlink(filepath.Join(dst, "dangling"))
+	assert.NoError(t, err)
+	assert.Equal(t, "missing", link)
+
+	fi1, err := os.Stat(filepath.Join(dst, "store/pkg/index.js"))
+	assert.NoError(t, err)
+	fi2, err := os.Stat(filepath.Join(dst, "node_modules/pkg/index.js"))
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(fi1, fi2), "hard link is not preserved")
+
+	fi, err := os.Lstat(filepath.Join(dst, "fifo"))
+	assert.NoError(t, err)
+	assert.True(t, fi.Mode()&os.ModeNamedPipe != 0, "named pipe is not preserved")
+
+	fi, err = os.Stat(filepath.Join(dst, "empty"))
+	assert.NoError(t, err)
+	assert.True(t, fi.Mode().IsRegular())
+	assert.Equal(t, int64(0), fi.Size())
+
+	fi, err = os.Stat(filepath.Join(dst, "empty_dir"))
+	assert.NoError(t, err)
+	assert.True(t, fi.IsDir())
+	assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+}
+
+func TestRebuildSkipOutsideLinks(t *testing.T) {
+	engines := map[string][2]func(Cache, string, string, Options) error{
+		"go":  {Rebuild, Restore},
+		"tar": {RebuildCmd, RestoreCmd},
+	}
+	if _, err := exec.LookPath("tar"); err != nil {
+		delete(engines, "tar")
+	}
+
+	for engine, fns := range engines {
+		src, dst := tempDir(t), tempDir(t)
+		writeTestFile(t, src, "bin/tool", "tool")
+		assert.NoError(t, os.Symlink("/usr/bin/python3", filepath.Join(src, "bin/python")))
+		assert.NoError(t, os.Symlink("../../shared", filepath.Join(src, "bin/shared")))
+		assert.NoError(t, os.Symlink("tool", filepath.Join(src, "bin/alias")))
+
+		c := newMemCache()
+		assert.NoError(t, fns[0](c, src, "archive", Options{}), engine)
+		assert.NoError(t, fns[1](c, "archive", dst, Options{}), engine)
+
+		for _, name := range []string{"bin/python", "bin/shared"} {
+			_, err := os.Lstat(filepath.Join(dst, name))
+			assert.True(t, os.IsNotExist(err), "%s: %s is archived", engine, name)
+		}
+		link, err := os.Readlink(filepath.Join(dst, "bin/alias"))
+		assert.NoError(t, err, engine)
+		assert.Equal(t, "tool", link, engine)
+	}
+}
+
+func TestRebuildRelativeMount(t *testing.T) {
+	engines := map[string][2]func(Cache, string, string, Options) error{
+		"go":  {Rebuild, Restore},
+		"tar": {RebuildCmd, RestoreCmd},
+	}
+	if _, err := exec.LookPath("tar"); err != nil {
+		delete(engines, "tar")
+	}
+
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	defer os.Chdir(wd)
+
+	for engine, fns := range engines {
+		dir, dst := tempDir(t), tempDir(t)
+		assert.NoError(t, os.Chdir(dir))
+
+		// mounts are relative to the workspace
+		writeTestFile(t, dir, "mnt/tool/bin.js", "#!/usr/bin/env node")
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, "mnt/.bin"), 0755))
+		assert.NoError(t, os.Symlink(filepath.Join(dir, "mnt/tool/bin.js"), filepath.Join(dir, "mnt/.bin/abs")))
+
+		c := newMemCache()
+		assert.NoError(t, fns[0](c, "mnt", "archive", Options{}), engine)
+		assert.NoError(t, fns[1](c, "archive", dst, Options{}), engine)
+
+		link, err := os.Readlink(filepath.Join(dst, ".bin/abs"))
+		assert.NoError(t, err, engine)
+		assert.Equal(t, "../tool/bin.js", link, engine)
+	}
+}
+
+func TestArchiveHardLinkOnce(t *testing.T) {
+	src := tempDir(t)
+	writeTestFile(t, src, "a", "content")
+	assert.NoError(t, os.Link(filepath.Join(src, "a"), filepath.Join(src, "b")))
+
+	var buf bytes.Buffer
+	assert.NoError(t, archive(src, &buf))
+
+	tr := tar.NewReader(&buf)
+	var headers []*tar.Header
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		headers = append(headers, h)
+	}
+
+	assert.Len(t, headers, 2)
+	assert.Equal(t, byte(tar.TypeReg), headers[0].Typeflag)
+	assert.Equal(t, byte(tar.TypeLink), headers[1].Typeflag)
+	assert.Equal(t, "a", headers[1].Linkname)
+	assert.Equal(t, int64(0), headers[1].Size)
+}
+
+func TestRestoreOverwrite(t *testing.T) {
+	src, dst := tempDir(t), tempDir(t)
+	writeTestFile(t, src, "a", "new")
+
+	// an existing symlink must be replaced, not followed
+	outside := filepath.Join(tempDir(t), "outside")
+	writeTestFile(t, filepath.Dir(outside), "outside", "keep")
+	assert.NoError(t, os.Symlink(outside, filepath.Join(dst, "a")))
+
+	c := newMemCache()
+	assert.NoError(t, Rebuild(c, src, "archive", Options{}))
+	assert.NoError(t, Restore(c, "archive", dst, Options{}))
+
+	b, err := ioutil.ReadFile(filepath.Join(dst, "a"))
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(b))
+
+	b, err = ioutil.ReadFile(outside)
+	assert.NoError(t, err)
+	assert.Equal(t, "keep", string(b))
+}
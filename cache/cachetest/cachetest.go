@@ -0,0 +1,188 @@
+// Package cachetest implements the tests every cache backend has to pass.
+package cachetest
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appleboy/drone-sftp-cache/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+// Run runs the tests against the caches returned by newCache, which stores
+// its entries in the returned local directory.
+func Run(t *testing.T, newCache func(t *testing.T) (cache.Cache, string)) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, cache.Cache, string)
+	}{
+		{"PutGet", testPutGet},
+		{"PutTTL", testPutTTL},
+		{"InvalidMeta", testInvalidMeta},
+		{"PutAtomic", testPutAtomic},
+		{"RemoveStaleTemp", testRemoveStaleTemp},
+		{"Create", testCreate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, dir := newCache(t)
+			tt.fn(t, c, dir)
+		})
+	}
+}
+
+// helper function to read the cache entry p.
+func readEntry(t *testing.T, c cache.Cache, p string) string {
+	rc, err := c.Get(p)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+// helper function to return the names of the entries listed in dir.
+func listEntries(t *testing.T, c cache.Cache, dir string) []string {
+	files, err := c.List(dir)
+	assert.NoError(t, err)
+	var names []string
+	for _, fi := range files {
+		if !fi.IsDir() {
+			names = append(names, fi.Name())
+		}
+	}
+	return names
+}
+
+func testPutGet(t *testing.T, c cache.Cache, dir string) {
+	p := filepath.Join(dir, "repo", "archive")
+
+	assert.NoError(t, c.Put(p, 0, strings.NewReader("content")))
+	assert.Equal(t, "content", readEntry(t, c, p))
+	assert.Equal(t, []string{"archive"}, listEntries(t, c, filepath.Join(dir, "repo")))
+
+	// builds of other users read the entry as well
+	fi, err := os.Stat(p)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0044), fi.Mode().Perm()&0044)
+
+	assert.NoError(t, c.Remove(p))
+	_, err = c.Get(p)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(p + cache.MetaSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	// a missing directory is an empty cache
+	assert.Empty(t, listEntries(t, c, filepath.Join(dir, "missing")))
+}
+
+func testPutTTL(t *testing.T, c cache.Cache, dir string) {
+	p := filepath.Join(dir, "archive")
+
+	assert.NoError(t, c.Put(p, time.Hour, strings.NewReader("fresh")))
+	assert.Equal(t, "fresh", readEntry(t, c, p))
+
+	// metadata is not listed as a cache entry
+	assert.Equal(t, []string{"archive"}, listEntries(t, c, dir))
+
+	// expire the entry
+	b, err := (&cache.Metadata{Expires: time.Now().Add(-time.Second)}).Marshal()
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(p+cache.MetaSuffix, b, 0644))
+	_, err = c.Get(p)
+	assert.True(t, os.IsNotExist(err), "expired entry: %v", err)
+
+	// a rebuild without ttl never expires
+	assert.NoError(t, c.Put(p, 0, strings.NewReader("forever")))
+	assert.Equal(t, "forever", readEntry(t, c, p))
+	b, err = ioutil.ReadFile(p + cache.MetaSuffix)
+	assert.NoError(t, err)
+	assert.True(t, cache.ParseMetadata(b).Expires.IsZero())
+}
+
+func testInvalidMeta(t *testing.T, c cache.Cache, dir string) {
+	p := filepath.Join(dir, "archive")
+	assert.NoError(t, c.Put(p, time.Hour, strings.NewReader("content")))
+
+	// metadata left behind by an interrupted write
+	for _, meta := range []string{"", `{"expires":`} {
+		assert.NoError(t, ioutil.WriteFile(p+cache.MetaSuffix, []byte(meta), 0644))
+		assert.Equal(t, "content", readEntry(t, c, p), "metadata %q", meta)
+	}
+}
+
+func testPutAtomic(t *testing.T, c cache.Cache, dir string) {
+	p := filepath.Join(dir, "archive")
+	assert.NoError(t, c.Put(p, 0, strings.NewReader("old")))
+
+	r, w := io.Pipe()
+	done := make(chan error)
+	go func() { done <- c.Put(p, 0, r) }()
+	_, err := w.Write([]byte("new content"))
+	assert.NoError(t, err)
+
+	// the entry is not replaced before the write finished, temporary files
+	// are not listed as cache entries
+	assert.Equal(t, "old", readEntry(t, c, p))
+	assert.Equal(t, []string{"archive"}, listEntries(t, c, dir))
+
+	assert.NoError(t, w.Close())
+	assert.NoError(t, <-done)
+	assert.Equal(t, "new content", readEntry(t, c, p))
+
+	// a failed write leaves the entry as it is
+	r, w = io.Pipe()
+	go func() { done <- c.Put(p, 0, r) }()
+	w.CloseWithError(io.ErrUnexpectedEOF)
+	assert.Error(t, <-done)
+	assert.Equal(t, "new content", readEntry(t, c, p))
+	assert.Equal(t, []string{"archive"}, listEntries(t, c, dir))
+}
+
+func testRemoveStaleTemp(t *testing.T, c cache.Cache, dir string) {
+	stale := cache.TempName(filepath.Join(dir, "other"))
+	active := cache.TempName(filepath.Join(dir, "other"))
+	for _, name := range []string{stale, stale + cache.MetaSuffix, active} {
+		assert.NoError(t, ioutil.WriteFile(name, []byte("partial"), 0644))
+	}
+	old := time.Now().Add(-2 * cache.TempMaxAge)
+	assert.NoError(t, os.Chtimes(stale, old, old))
+	assert.NoError(t, os.Chtimes(stale+cache.MetaSuffix, old, old))
+
+	assert.NoError(t, c.Put(filepath.Join(dir, "archive"), 0, strings.NewReader("content")))
+
+	_, err := os.Stat(stale)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(stale + cache.MetaSuffix)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(active)
+	assert.NoError(t, err)
+}
+
+func testCreate(t *testing.T, c cache.Cache, dir string) {
+	ex, ok := c.(cache.Exclusive)
+	if !ok {
+		t.Skip("no exclusive creates")
+	}
+	p := filepath.Join(dir, "repo", "archive.lock")
+
+	assert.NoError(t, ex.Create(p, 0, strings.NewReader("first")))
+	err := ex.Create(p, 0, strings.NewReader("second"))
+	assert.True(t, os.IsExist(err), "unexpected error %v", err)
+	assert.Equal(t, "first", readEntry(t, c, p))
+
+	// no temporary files are left behind
+	files, err := ioutil.ReadDir(filepath.Join(dir, "repo"))
+	assert.NoError(t, err)
+	for _, fi := range files {
+		assert.False(t, cache.IsTemp(fi.Name()), fi.Name())
+	}
+}
@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression identifies the algorithm used to compress cache archives.
+type Compression string
+
+// Supported compression algorithms.
+const (
+	None Compression = "none"
+	Gzip Compression = "gzip"
+	Zstd Compression = "zstd"
+)
+
+// magic numbers used to detect the compression of an archive stream.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ParseCompression returns the Compression matching the given name. An empty
+// name means no compression.
+func ParseCompression(name string) (Compression, error) {
+	switch c := Compression(name); c {
+	case "", None:
+		return None, nil
+	case Gzip, Zstd:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unsupported compression %q", name)
+	}
+}
+
+// CheckLevel returns an error if level is not a valid level of the
+// compression c. Zero always selects the algorithm default.
+func CheckLevel(c Compression, level int) error {
+	if level == 0 {
+		return nil
+	}
+
+	min, max := 0, 0
+	switch c {
+	case Gzip:
+		min, max = gzip.BestSpeed, gzip.BestCompression
+	case Zstd:
+		min, max = 1, 22
+	}
+	if level < min || level > max {
+		if min == max {
+			return fmt.Errorf("compression level %d requires compression", level)
+		}
+		return fmt.Errorf("unsupported %s compression level %d, expected %d to %d", c, level, min, max)
+	}
+	return nil
+}
+
+// helper function to wrap io.Writer w with the requested compression. The
+// returned io.WriteCloser must be closed to flush the compressed stream, it
+// does not close w.
+func compress(w io.Writer, c Compression, level int) (io.WriteCloser, error) {
+	switch c {
+	case "", None:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case Zstd:
+		opts := []zstd.EOption{}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", c)
+	}
+}
+
+// helper function to wrap io.Reader r with a decompressor matching the magic
+// bytes at the start of the stream. Streams without a known magic number are
+// returned as is, so uncompressed archives keep working.
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	// a short or empty stream is not an error here, let the tar reader decide
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		d, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReader{d}, nil
+	default:
+		return ioutil.NopCloser(br), nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// zstdReader adapts zstd.Decoder to the io.ReadCloser interface.
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (z zstdReader) Close() error {
+	z.Decoder.Close()
+	return nil
+}
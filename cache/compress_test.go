@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("drone sftp cache "), 1024)
+
+	tests := []struct {
+		compression Compression
+		level       int
+	}{
+		{None, 0},
+		{Gzip, 0},
+		{Gzip, 9},
+		{Zstd, 0},
+		{Zstd, 19},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w, err := compress(&buf, tt.compression, tt.level)
+		assert.NoError(t, err)
+		_, err = w.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+
+		if tt.compression != None {
+			assert.True(t, buf.Len() < len(data), "%s archive is not compressed", tt.compression)
+		}
+
+		r, err := decompress(&buf)
+		assert.NoError(t, err)
+		out, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.NoError(t, r.Close())
+		assert.Equal(t, data, out, "%s round trip", tt.compression)
+	}
+}
+
+func TestDecompressEmpty(t *testing.T) {
+	r, err := decompress(bytes.NewReader(nil))
+	assert.NoError(t, err)
+	out, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Empty(t, out)
+}
+
+func TestParseCompression(t *testing.T) {
+	c, err := ParseCompression("")
+	assert.NoError(t, err)
+	assert.Equal(t, None, c)
+
+	c, err = ParseCompression("zstd")
+	assert.NoError(t, err)
+	assert.Equal(t, Zstd, c)
+
+	_, err = ParseCompression("bzip2")
+	assert.Error(t, err)
+}
+
+func TestCheckLevel(t *testing.T) {
+	assert.NoError(t, CheckLevel(None, 0))
+	assert.NoError(t, CheckLevel(Gzip, 0))
+	assert.NoError(t, CheckLevel(Gzip, 9))
+	assert.NoError(t, CheckLevel(Zstd, 19))
+
+	assert.Error(t, CheckLevel(None, 3))
+	assert.Error(t, CheckLevel(Gzip, 10))
+	assert.Error(t, CheckLevel(Gzip, -2))
+	assert.Error(t, CheckLevel(Zstd, -1))
+	assert.Error(t, CheckLevel(Zstd, 23))
+}
@@ -0,0 +1,281 @@
+package local
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/appleboy/drone-sftp-cache/cache"
+)
+
+// fileMode is the mode of the entries and their metadata.
+const fileMode = 0644
+
+// errOutside is returned for entries outside the cache directory.
+var errOutside = errors.New("outside the cache directory")
+
+// cacher is a local file system implementation of the Cache.
+type cacher struct {
+	root string
+}
+
+// New returns a Cache storing the entries in the directory root, like a
+// volume shared by the builds of a host. Entry paths are absolute paths in
+// the directory or relative to it, other paths are refused.
+func New(root string) (cache.Cache, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &cacher{root: root}, nil
+}
+
+// path returns the file system path of the entry p.
+func (c *cacher) path(op, p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(c.root, p)
+	}
+	p = filepath.Clean(p)
+
+	rel, err := filepath.Rel(c.root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &os.PathError{Op: op, Path: p, Err: errOutside}
+	}
+	return p, nil
+}
+
+// List returns a list of all files at the defined path. The access time of
+// an entry is recorded as the modification time of its metadata, the file
+// system may not update access times.
+func (c *cacher) List(root string) ([]os.FileInfo, error) {
+	root, err := c.path("list", root)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*fileInfo
+	accessed := map[string]time.Time{}
+	err = filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		// a missing root is an empty cache
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		switch name := fi.Name(); {
+		case cache.IsTemp(name):
+		case cache.IsMeta(name):
+			accessed[strings.TrimSuffix(p, cache.MetaSuffix)] = fi.ModTime()
+		default:
+			entries = append(entries, &fileInfo{FileInfo: fi, path: p})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]os.FileInfo, len(entries))
+	for i, fi := range entries {
+		fi.atime = fi.ModTime()
+		if t, ok := accessed[fi.path]; ok && t.After(fi.atime) {
+			fi.atime = t
+		}
+		files[i] = fi
+	}
+	return files, nil
+}
+
+// Get opens the entry for reading. An expired entry does not exist, reading
+// another one touches its metadata to record the access for the eviction.
+func (c *cacher) Get(p string) (io.ReadCloser, error) {
+	p, err := c.path("get", p)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := readMeta(p)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if m.Expired(time.Now()) {
+		f.Close()
+		return nil, &os.PathError{Op: "get", Path: p, Err: os.ErrNotExist}
+	}
+
+	now := time.Now()
+	os.Chtimes(p+cache.MetaSuffix, now, now)
+	return f, nil
+}
+
+// Put writes the contents of the io.Reader to the entry, through a
+// temporary file renamed into place so readers never see a partial entry.
+// A positive duration t makes the entry expire after it.
+func (c *cacher) Put(p string, t time.Duration, src io.Reader) error {
+	p, err := c.path("put", p)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := c.writeTemp(p, t, src)
+	if err != nil {
+		return err
+	}
+
+	// the data goes first, see cache.MetaSuffix
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		os.Remove(tmp + cache.MetaSuffix)
+		return err
+	}
+	if err := os.Rename(tmp+cache.MetaSuffix, p+cache.MetaSuffix); err != nil {
+		os.Remove(tmp + cache.MetaSuffix)
+		return err
+	}
+	return nil
+}
+
+// Create writes the file like Put, but fails with an error satisfying
+// os.IsExist if it exists already. The complete temporary file is linked to
+// the name, so the entry appears with its content at once.
+func (c *cacher) Create(p string, t time.Duration, src io.Reader) error {
+	p, err := c.path("create", p)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := c.writeTemp(p, t, src)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer os.Remove(tmp + cache.MetaSuffix)
+
+	if err := os.Link(tmp, p); err != nil {
+		return err
+	}
+	return os.Rename(tmp+cache.MetaSuffix, p+cache.MetaSuffix)
+}
+
+// Remove removes the file and its metadata.
+func (c *cacher) Remove(p string) error {
+	p, err := c.path("remove", p)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); err != nil {
+		return err
+	}
+	if err := os.Remove(p + cache.MetaSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeTemp writes the content and metadata of the entry p to a temporary
+// file in its directory, and returns the name of the temporary file.
+// Temporary files left in the directory by interrupted writes are removed.
+func (c *cacher) writeTemp(p string, t time.Duration, src io.Reader) (string, error) {
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	removeStale(dir)
+
+	tmp := cache.TempName(p)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileMode)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(f, src)
+	if err == nil {
+		// builds of other users share the directory, whatever their umask
+		err = f.Chmod(fileMode)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	m := new(cache.Metadata)
+	if t > 0 {
+		m.Expires = time.Now().Add(t)
+	}
+	if err := writeMeta(tmp, m); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// removeStale removes the temporary files in the directory older than
+// cache.TempMaxAge.
+func removeStale(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, fi := range files {
+		if cache.IsStaleTemp(fi, now) {
+			os.Remove(filepath.Join(dir, fi.Name()))
+		}
+	}
+}
+
+// readMeta returns the metadata stored for the cache entry p. A missing
+// metadata file is the same as empty metadata, see cache.ParseMetadata.
+func readMeta(p string) (*cache.Metadata, error) {
+	b, err := ioutil.ReadFile(p + cache.MetaSuffix)
+	if os.IsNotExist(err) {
+		return new(cache.Metadata), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cache.ParseMetadata(b), nil
+}
+
+// writeMeta stores the metadata for the cache entry p.
+func writeMeta(p string, m *cache.Metadata) error {
+	b, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p+cache.MetaSuffix, b, fileMode); err != nil {
+		return err
+	}
+	return os.Chmod(p+cache.MetaSuffix, fileMode)
+}
+
+// fileInfo is an os.FileInfo recording the time the file was last read.
+type fileInfo struct {
+	os.FileInfo
+	path  string
+	atime time.Time
+}
+
+// AccessTime returns the time the file was last read.
+func (fi *fileInfo) AccessTime() time.Time {
+	return fi.atime
+}
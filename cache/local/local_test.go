@@ -0,0 +1,94 @@
+package local
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/appleboy/drone-sftp-cache/cache"
+	"github.com/appleboy/drone-sftp-cache/cache/cachetest"
+	"github.com/stretchr/testify/assert"
+)
+
+// helper function to return a cache on a temporary directory.
+func newTestCacher(t *testing.T) (*cacher, string) {
+	dir := t.TempDir()
+	c, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.(*cacher), dir
+}
+
+// helper function to read the cache entry p.
+func readEntry(t *testing.T, c cache.Cache, p string) string {
+	rc, err := c.Get(p)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func TestCache(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) (cache.Cache, string) {
+		return newTestCacher(t)
+	})
+}
+
+func TestRelativePath(t *testing.T) {
+	c, dir := newTestCacher(t)
+	p := filepath.Join(dir, "repo", "archive")
+	assert.NoError(t, c.Put(p, 0, strings.NewReader("content")))
+
+	// relative paths are in the directory
+	assert.Equal(t, "content", readEntry(t, c, "repo/archive"))
+}
+
+func TestGetAccessTime(t *testing.T) {
+	c, dir := newTestCacher(t)
+	p := filepath.Join(dir, "archive")
+
+	assert.NoError(t, c.Put(p, 0, strings.NewReader("content")))
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, name := range []string{p, p + cache.MetaSuffix} {
+		assert.NoError(t, os.Chtimes(name, old, old))
+	}
+
+	files, err := c.List(dir)
+	assert.NoError(t, err)
+	if assert.Len(t, files, 2) {
+		assert.Equal(t, old, cache.AccessTime(files[1]))
+	}
+
+	readEntry(t, c, p)
+
+	files, err = c.List(dir)
+	assert.NoError(t, err)
+	if assert.Len(t, files, 2) {
+		assert.True(t, cache.AccessTime(files[1]).After(old), "access time is not updated")
+		assert.Equal(t, old, files[1].ModTime())
+	}
+}
+
+func TestOutside(t *testing.T) {
+	c, dir := newTestCacher(t)
+
+	for _, p := range []string{
+		filepath.Dir(dir),
+		filepath.Join(dir, "..", "archive"),
+		"../archive",
+	} {
+		assert.Error(t, c.Put(p, 0, strings.NewReader("content")), p)
+		_, err := c.Get(p)
+		assert.Error(t, err, p)
+		_, err = c.List(p)
+		assert.Error(t, err, p)
+		assert.Error(t, c.Remove(p), p)
+	}
+}
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Cache backends store an entry as a file named after it, with its Metadata
+// in a file next to it named with MetaSuffix appended. Entries are written
+// to a temporary file named by TempName and renamed into place, the data
+// before the metadata. An interrupted write then leaves the temporary
+// metadata to the removal of stale temporary files, and never metadata
+// without its entry, which is neither listed nor evicted.
+const (
+	// MetaSuffix is appended to the name of a cache entry to store its
+	// metadata.
+	MetaSuffix = ".meta"
+
+	// PartSuffix is appended to the temporary name an entry is written to.
+	PartSuffix = ".part"
+
+	// TempMaxAge is the time after which a temporary file left by an
+	// interrupted write is removed.
+	TempMaxAge = 24 * time.Hour
+)
+
+// Metadata is stored next to a cache entry.
+type Metadata struct {
+	// Expires is the time the entry expires, zero means never.
+	Expires time.Time `json:"expires,omitempty"`
+
+	// Size and Checksum describe the complete entry, the checksum is the
+	// hex encoded sha256 of its content.
+	Size     int64  `json:"size,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+
+	// Chunk and Chunks are the checksums of the leading chunks of the given
+	// size. They describe the chunks a partial upload wrote already, and
+	// all chunks of a complete entry, which are verified before they are
+	// read.
+	Chunk  int64    `json:"chunk,omitempty"`
+	Chunks []string `json:"chunks,omitempty"`
+
+	// Heartbeat is the time a partial upload was last seen alive.
+	Heartbeat time.Time `json:"heartbeat,omitempty"`
+}
+
+// ParseMetadata returns the metadata stored in b. Empty or invalid metadata,
+// left behind by an interrupted write, is the same as empty metadata.
+func ParseMetadata(b []byte) *Metadata {
+	m := new(Metadata)
+	if err := json.Unmarshal(b, m); err != nil {
+		return new(Metadata)
+	}
+	return m
+}
+
+// Marshal returns the metadata in its stored form.
+func (m *Metadata) Marshal() ([]byte, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// Expired reports whether the entry expired at the time now.
+func (m *Metadata) Expired(now time.Time) bool {
+	return !m.Expires.IsZero() && now.After(m.Expires)
+}
+
+// Chunked reports whether the checksums of the chunks cover the entry of
+// the given size.
+func (m *Metadata) Chunked(size int64) bool {
+	return m.Chunk > 0 && m.Size == size && int64(len(m.Chunks)) == (size+m.Chunk-1)/m.Chunk
+}
+
+// TempName returns a unique temporary name in the directory of the entry p.
+func TempName(p string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return filepath.Join(filepath.Dir(p), TempPrefix(p)+hex.EncodeToString(b)+PartSuffix)
+}
+
+// TempPrefix returns the prefix of the temporary names of the entry p.
+func TempPrefix(p string) string {
+	return "." + filepath.Base(p) + "."
+}
+
+// IsMeta reports whether the file name belongs to metadata.
+func IsMeta(name string) bool {
+	return strings.HasSuffix(name, MetaSuffix)
+}
+
+// IsTemp reports whether the file name belongs to a temporary file or its
+// metadata.
+func IsTemp(name string) bool {
+	base := strings.TrimSuffix(filepath.Base(name), MetaSuffix)
+	return strings.HasPrefix(base, ".") && strings.HasSuffix(base, PartSuffix)
+}
+
+// IsStaleTemp reports whether fi describes a temporary file or its metadata
+// older than TempMaxAge at the time now.
+func IsStaleTemp(fi os.FileInfo, now time.Time) bool {
+	return IsTemp(fi.Name()) && now.Sub(fi.ModTime()) > TempMaxAge
+}
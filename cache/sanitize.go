@@ -0,0 +1,253 @@
+package cache
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// UnsafeArchiveError is returned when an archive entry would be restored
+// outside of the destination directory or the archive exceeds the limits
+// configured in Options.
+type UnsafeArchiveError struct {
+	Name   string
+	Reason string
+}
+
+func (e *UnsafeArchiveError) Error() string {
+	return fmt.Sprintf("unsafe archive entry %q: %s", e.Name, e.Reason)
+}
+
+// maxLinks limits the number of symlinks followed to resolve a path, like
+// the operating system does.
+const maxLinks = 40
+
+// validator checks archive entries before they are restored to dst.
+type validator struct {
+	dst   string
+	opts  Options
+	files int
+	bytes int64
+
+	// entries are the files of the archive checked so far by their
+	// resolved path. The tar binary extracts an entry some time after it
+	// was checked, so the disk does not show them yet.
+	entries map[string]entry
+}
+
+// entry is a file the archive leaves at a path.
+type entry struct {
+	mode os.FileMode
+	link string
+}
+
+func newValidator(dst string, opts Options) (*validator, error) {
+	// symlinks in the destination path itself are trusted
+	dst, err := filepath.EvalSymlinks(dst)
+	if err != nil {
+		return nil, err
+	}
+	return &validator{dst: dst, opts: opts, entries: map[string]entry{}}, nil
+}
+
+// check validates the header and strips the setuid and setgid bits from its
+// mode. It returns an UnsafeArchiveError for entries which escape the
+// destination directory or exceed the limits.
+func (v *validator) check(header *tar.Header) error {
+	unsafe := func(reason string, args ...interface{}) error {
+		return &UnsafeArchiveError{Name: header.Name, Reason: fmt.Sprintf(reason, args...)}
+	}
+
+	if !local(header.Name) {
+		return unsafe("path escapes the destination")
+	}
+
+	// a symlink already on disk or earlier in the archive must not
+	// redirect the entry
+	target, err := v.resolve(v.dst, header.Name, false, new(int))
+	if err != nil {
+		return unsafe("%v", err)
+	}
+	if !within(v.dst, target) {
+		return unsafe("path resolves to %q", target)
+	}
+
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		if !localLink(header.Name, header.Linkname) {
+			return unsafe("symlink target %q escapes the destination", header.Linkname)
+		}
+		resolved, err := v.resolve(filepath.Dir(target), header.Linkname, true, new(int))
+		if err != nil {
+			return unsafe("symlink target %q: %v", header.Linkname, err)
+		}
+		if !within(v.dst, resolved) {
+			return unsafe("symlink target %q resolves to %q", header.Linkname, resolved)
+		}
+	case tar.TypeLink:
+		if !local(header.Linkname) {
+			return unsafe("hard link target %q escapes the destination", header.Linkname)
+		}
+		resolved, err := v.resolve(v.dst, header.Linkname, false, new(int))
+		if err != nil {
+			return unsafe("hard link target %q: %v", header.Linkname, err)
+		}
+		if !within(v.dst, resolved) {
+			return unsafe("hard link target %q resolves to %q", header.Linkname, resolved)
+		}
+
+		// a hard link to a symlink is a copy of it, the copy would resolve
+		// its target relative to another directory
+		if mode, _, err := v.lstat(resolved); err == nil && mode&os.ModeSymlink != 0 {
+			return unsafe("hard link target %q is a symlink", header.Linkname)
+		}
+	}
+
+	header.Mode &^= 04000 | 02000
+
+	v.files++
+	if v.opts.MaxFiles > 0 && v.files > v.opts.MaxFiles {
+		return unsafe("archive exceeds the limit of %d files", v.opts.MaxFiles)
+	}
+	v.bytes += header.Size
+	if v.opts.MaxBytes > 0 && v.bytes > v.opts.MaxBytes {
+		return unsafe("archive exceeds the limit of %d bytes", v.opts.MaxBytes)
+	}
+
+	v.record(target, header)
+	return nil
+}
+
+// resolve returns the path of name relative to the directory dir with its
+// symlinks followed, as the archive entries checked so far leave the disk.
+// The last element is only followed if follow is set, and links counts the
+// symlinks followed.
+//
+// A ".." element is an error after a symlink or a missing file. Later
+// entries may replace those, and the parent of the replacement could be
+// outside the destination. Directories are never replaced by the
+// extraction, so the result stays valid until the archive is restored.
+func (v *validator) resolve(dir, name string, follow bool, links *int) (string, error) {
+	cur := dir
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) {
+		cur = filepath.VolumeName(name) + string(filepath.Separator)
+		name = name[len(filepath.VolumeName(name)):]
+	}
+	elems := strings.FieldsFunc(name, func(r rune) bool {
+		return r == '/' || r == filepath.Separator
+	})
+
+	fixed := true
+	for i, elem := range elems {
+		switch elem {
+		case ".":
+			continue
+		case "..":
+			if !fixed {
+				return "", fmt.Errorf("%q follows a symlink or missing directory", "..")
+			}
+			cur = filepath.Dir(cur)
+			continue
+		}
+
+		cur = filepath.Join(cur, elem)
+		if i == len(elems)-1 && !follow {
+			break
+		}
+
+		mode, link, err := v.lstat(cur)
+		switch {
+		case os.IsNotExist(err):
+			fixed = false
+		case err != nil:
+			return "", err
+		case mode&os.ModeSymlink != 0:
+			fixed = false
+			if *links++; *links > maxLinks {
+				return "", errors.New("too many levels of symlinks")
+			}
+			if cur, err = v.resolve(filepath.Dir(cur), link, true, links); err != nil {
+				return "", err
+			}
+		case !mode.IsDir():
+			fixed = false
+		}
+	}
+	return cur, nil
+}
+
+// lstat returns the mode of the file p and the target of a symlink, as the
+// archive entries checked so far leave it.
+func (v *validator) lstat(p string) (os.FileMode, string, error) {
+	if e, ok := v.entries[p]; ok {
+		return e.mode, e.link, nil
+	}
+
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return 0, "", err
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return fi.Mode(), "", nil
+	}
+	link, err := os.Readlink(p)
+	return fi.Mode(), filepath.ToSlash(link), err
+}
+
+// record notes the entry at its resolved path p for the checks of the
+// following entries. Directories stay what they are, the extraction does
+// not replace them and a directory entry does not replace other files.
+func (v *validator) record(p string, header *tar.Header) {
+	if mode, _, err := v.lstat(p); err == nil && (mode.IsDir() || header.Typeflag == tar.TypeDir) {
+		return
+	}
+	v.entries[p] = entry{mode: header.FileInfo().Mode(), link: header.Linkname}
+}
+
+// helper function to check that the slash separated archive name is a
+// relative path that stays inside the destination.
+func local(name string) bool {
+	if name == "" || path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return false
+	}
+	clean := path.Clean(strings.Replace(name, `\`, "/", -1))
+	return clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// helper function to check that the target of the symlink name is relative
+// and stays inside the destination.
+func localLink(name, target string) bool {
+	return !path.IsAbs(target) && local(path.Join(path.Dir(name), target))
+}
+
+// helper function to copy the archive read from io.Reader r to io.Writer w,
+// validating every entry on the way. It is used to guard the tar binary.
+func filter(w io.Writer, r io.Reader, v *validator) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return tw.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if err := v.check(header); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
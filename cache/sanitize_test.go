@@ -0,0 +1,244 @@
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// helper function to build a tar archive from the headers, regular files
+// are filled with their size in zero bytes.
+func tarball(t *testing.T, headers ...*tar.Header) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range headers {
+		if h.Typeflag == tar.TypeReg && h.Mode == 0 {
+			h.Mode = 0644
+		}
+		assert.NoError(t, tw.WriteHeader(h))
+		if h.Typeflag == tar.TypeReg {
+			_, err := tw.Write(make([]byte, h.Size))
+			assert.NoError(t, err)
+		}
+	}
+	assert.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestRestoreUnsafe(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []*tar.Header
+		opts    Options
+	}{
+		{
+			"parent directory",
+			[]*tar.Header{{Name: "../evil", Typeflag: tar.TypeReg}},
+			Options{},
+		},
+		{
+			"nested parent directory",
+			[]*tar.Header{{Name: "a/../../evil", Typeflag: tar.TypeReg}},
+			Options{},
+		},
+		{
+			"absolute path",
+			[]*tar.Header{{Name: "/tmp/evil", Typeflag: tar.TypeReg}},
+			Options{},
+		},
+		{
+			"absolute symlink",
+			[]*tar.Header{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"}},
+			Options{},
+		},
+		{
+			"relative symlink",
+			[]*tar.Header{{Name: "a/link", Typeflag: tar.TypeSymlink, Linkname: "../../etc"}},
+			Options{},
+		},
+		{
+			"hard link",
+			[]*tar.Header{{Name: "link", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"}},
+			Options{},
+		},
+		{
+			"chained symlinks",
+			[]*tar.Header{
+				{Name: "b/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "b/.."},
+				{Name: "c", Typeflag: tar.TypeSymlink, Linkname: "a/.."},
+				{Name: "c/evil", Typeflag: tar.TypeReg},
+			},
+			Options{},
+		},
+		{
+			"symlink through missing directory",
+			[]*tar.Header{
+				{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "missing/.."},
+				{Name: "missing", Typeflag: tar.TypeSymlink, Linkname: "."},
+				{Name: "a/evil", Typeflag: tar.TypeReg},
+			},
+			Options{},
+		},
+		{
+			"hard link to symlink",
+			[]*tar.Header{
+				{Name: "b/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "b/link", Typeflag: tar.TypeSymlink, Linkname: "../evil"},
+				{Name: "link", Typeflag: tar.TypeLink, Linkname: "b/link"},
+			},
+			Options{},
+		},
+		{
+			"too many files",
+			[]*tar.Header{
+				{Name: "a", Typeflag: tar.TypeReg},
+				{Name: "b", Typeflag: tar.TypeReg},
+				{Name: "c", Typeflag: tar.TypeReg},
+			},
+			Options{MaxFiles: 2},
+		},
+		{
+			"too many bytes",
+			[]*tar.Header{
+				{Name: "a", Typeflag: tar.TypeReg, Size: 600},
+				{Name: "b", Typeflag: tar.TypeReg, Size: 600},
+			},
+			Options{MaxBytes: 1000},
+		},
+	}
+
+	restores := map[string]func(Cache, string, string, Options) error{
+		"go":  Restore,
+		"tar": RestoreCmd,
+	}
+	if _, err := exec.LookPath("tar"); err != nil {
+		delete(restores, "tar")
+	}
+
+	for _, tt := range tests {
+		for engine, restore := range restores {
+			root := tempDir(t)
+			dst := filepath.Join(root, "mount")
+
+			c := newMemCache()
+			c.files["archive"] = tarball(t, tt.headers...)
+
+			err := restore(c, "archive", dst, tt.opts)
+			_, ok := err.(*UnsafeArchiveError)
+			assert.True(t, ok, "%s (%s): unexpected error %v", tt.name, engine, err)
+
+			_, err = os.Lstat(filepath.Join(root, "evil"))
+			assert.True(t, os.IsNotExist(err), "%s (%s): file escaped", tt.name, engine)
+		}
+	}
+}
+
+func TestRestoreExistingSymlink(t *testing.T) {
+	root := tempDir(t)
+	dst := filepath.Join(root, "mount")
+	outside := filepath.Join(root, "outside")
+	assert.NoError(t, os.MkdirAll(dst, 0755))
+	assert.NoError(t, os.MkdirAll(outside, 0755))
+	assert.NoError(t, os.Symlink(outside, filepath.Join(dst, "dir")))
+
+	c := newMemCache()
+	c.files["archive"] = tarball(t, &tar.Header{Name: "dir/evil", Typeflag: tar.TypeReg})
+
+	err := Restore(c, "archive", dst, Options{})
+	assert.IsType(t, &UnsafeArchiveError{}, err)
+
+	_, err = os.Lstat(filepath.Join(outside, "evil"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRestoreChainedSymlinks(t *testing.T) {
+	restores := map[string]func(Cache, string, string, Options) error{
+		"go":  Restore,
+		"tar": RestoreCmd,
+	}
+	if _, err := exec.LookPath("tar"); err != nil {
+		delete(restores, "tar")
+	}
+
+	for engine, restore := range restores {
+		root := tempDir(t)
+		dst := filepath.Join(root, "mount")
+		writeTestFile(t, root, "secret", "secret")
+
+		// each symlink is inside the destination on its own, the chain
+		// resolves to its parent
+		c := newMemCache()
+		c.files["archive"] = tarball(t,
+			&tar.Header{Name: "b/", Typeflag: tar.TypeDir, Mode: 0755},
+			&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "b/.."},
+			&tar.Header{Name: "c", Typeflag: tar.TypeSymlink, Linkname: "a/.."},
+			&tar.Header{Name: "h", Typeflag: tar.TypeLink, Linkname: "c/secret"},
+		)
+
+		err := restore(c, "archive", dst, Options{})
+		assert.IsType(t, &UnsafeArchiveError{}, err, engine)
+
+		for _, name := range []string{"c", "h"} {
+			_, err = os.Lstat(filepath.Join(dst, name))
+			assert.True(t, os.IsNotExist(err), "%s: %s is restored", engine, name)
+		}
+	}
+}
+
+func TestRestoreSymlinkChain(t *testing.T) {
+	dst := tempDir(t)
+
+	// symlinks to symlinks inside the destination are fine
+	c := newMemCache()
+	c.files["archive"] = tarball(t,
+		&tar.Header{Name: "pkg/bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "pkg/bin/tool", Typeflag: tar.TypeReg, Size: 1},
+		&tar.Header{Name: "current", Typeflag: tar.TypeSymlink, Linkname: "pkg"},
+		&tar.Header{Name: ".bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: ".bin/tool", Typeflag: tar.TypeSymlink, Linkname: "../current/bin/tool"},
+		&tar.Header{Name: "tool", Typeflag: tar.TypeLink, Linkname: "current/bin/tool"},
+	)
+
+	assert.NoError(t, Restore(c, "archive", dst, Options{}))
+
+	fi1, err := os.Stat(filepath.Join(dst, ".bin/tool"))
+	assert.NoError(t, err)
+	fi2, err := os.Stat(filepath.Join(dst, "tool"))
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(fi1, fi2))
+}
+
+func TestRestoreStripSetuid(t *testing.T) {
+	dst := tempDir(t)
+
+	c := newMemCache()
+	c.files["archive"] = tarball(t,
+		&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 06755},
+		&tar.Header{Name: "bin/link", Typeflag: tar.TypeSymlink, Linkname: "tool"},
+	)
+
+	assert.NoError(t, Restore(c, "archive", dst, Options{MaxFiles: 3}))
+
+	fi, err := os.Stat(filepath.Join(dst, "bin/tool"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid))
+}
+
+func TestLocal(t *testing.T) {
+	assert.True(t, local("a"))
+	assert.True(t, local("./a/b/"))
+	assert.True(t, local("a/../b"))
+	assert.True(t, local("a/.."))
+	assert.False(t, local(""))
+	assert.False(t, local(".."))
+	assert.False(t, local("../a"))
+	assert.False(t, local("a/../../b"))
+	assert.False(t, local("/a"))
+}
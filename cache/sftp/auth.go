@@ -0,0 +1,205 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	// ErrKeyPassphraseMissing is returned for an encrypted private key
+	// without a passphrase.
+	ErrKeyPassphraseMissing = errors.New("private key is encrypted, missing the key passphrase")
+
+	// ErrKeyPassphraseWrong is returned when the passphrase does not decrypt
+	// the private key.
+	ErrKeyPassphraseWrong = errors.New("wrong passphrase for the private key")
+
+	// ErrCertificateKeyMismatch is returned for a user certificate which
+	// does not certify any of the configured private keys.
+	ErrCertificateKeyMismatch = errors.New("certificate does not match the private key")
+)
+
+// parseKey parses the PEM encoded private key, which is decrypted with the
+// passphrase if it is encrypted.
+func parseKey(key, passphrase string) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(key))
+
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == "" {
+			return nil, ErrKeyPassphraseMissing
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(key), []byte(passphrase))
+	}
+
+	switch {
+	case err == nil:
+		return signer, nil
+	case errors.Is(err, x509.IncorrectPasswordError):
+		return nil, ErrKeyPassphraseWrong
+	default:
+		return nil, fmt.Errorf("unsupported private key: %v", err)
+	}
+}
+
+// authMethods returns the SSH authentication methods of the configuration in
+// order of precedence. The private keys Key and KeyPath, followed by the keys
+// of the SSH agent, are offered first, then the password, then the password
+// and prompts answered by keyboard-interactive authentication. A private key
+// certified by the user certificate is offered with the certificate. It also returns the
+// connection to the agent, which must stay open while connecting.
+//
+// An agent which can not be reached is skipped, unless it is the only
+// method.
+func authMethods(cfg Config) ([]ssh.AuthMethod, io.Closer, error) {
+	var signers []ssh.Signer
+
+	if cfg.Key != "" {
+		signer, err := parseKey(cfg.Key, cfg.KeyPassphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		signers = append(signers, signer)
+	}
+
+	if cfg.KeyPath != "" {
+		b, err := ioutil.ReadFile(cfg.KeyPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, err := parseKey(string(b), cfg.KeyPassphrase)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", cfg.KeyPath, err)
+		}
+		signers = append(signers, signer)
+	}
+
+	signers, err := certSigners(cfg, signers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var conn net.Conn
+	if cfg.AgentSocket != "" {
+		var err error
+		conn, err = net.Dial("unix", cfg.AgentSocket)
+		if err != nil && len(signers) == 0 && cfg.Password == "" {
+			return nil, nil, fmt.Errorf("unable to connect to the SSH agent: %v", err)
+		}
+	}
+
+	var auths []ssh.AuthMethod
+
+	// all keys are offered in a single attempt, the client tries every
+	// method only once
+	if len(signers) > 0 || conn != nil {
+		auths = append(auths, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			if conn == nil {
+				return signers, nil
+			}
+			keys, err := agent.NewClient(conn).Signers()
+			if err != nil {
+				// the agent failing leaves the other keys
+				return signers, nil
+			}
+			return append(append([]ssh.Signer(nil), signers...), keys...), nil
+		}))
+	}
+
+	if cfg.Password != "" {
+		auths = append(auths, ssh.Password(cfg.Password))
+	}
+
+	// servers allowing keyboard-interactive only reject the password
+	if cfg.Password != "" || len(cfg.Prompts) > 0 {
+		auths = append(auths, ssh.KeyboardInteractive(challenge(cfg.Password, cfg.Prompts)))
+	}
+
+	if conn == nil {
+		return auths, nil, nil
+	}
+	return auths, conn, nil
+}
+
+// certSigners replaces the signer certified by the user certificate of the
+// configuration, if any, with one presenting the certificate.
+func certSigners(cfg Config, signers []ssh.Signer) ([]ssh.Signer, error) {
+	data := []byte(cfg.Certificate)
+	if cfg.CertificatePath != "" {
+		b, err := ioutil.ReadFile(cfg.CertificatePath)
+		if err != nil {
+			return nil, err
+		}
+		data = b
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return signers, nil
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the certificate: %v", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.UserCert {
+		return nil, errors.New("not an OpenSSH user certificate")
+	}
+
+	for i, signer := range signers {
+		if !bytes.Equal(signer.PublicKey().Marshal(), cert.Key.Marshal()) {
+			continue
+		}
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			return nil, err
+		}
+		signers[i] = certSigner
+		return signers, nil
+	}
+	return nil, ErrCertificateKeyMismatch
+}
+
+// challenge returns the keyboard-interactive challenge handler answering
+// the prompts from the map, and the remaining password prompts with the
+// password. Prompts are matched ignoring case, surrounding space and a
+// trailing colon.
+func challenge(password string, prompts map[string]string) ssh.KeyboardInteractiveChallenge {
+	answers := map[string]string{}
+	for prompt, answer := range prompts {
+		answers[normalizePrompt(prompt)] = answer
+	}
+
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		replies := make([]string, len(questions))
+		for i, q := range questions {
+			prompt := normalizePrompt(q)
+			if answer, ok := answers[prompt]; ok {
+				replies[i] = answer
+				continue
+			}
+			if password != "" && strings.Contains(prompt, "password") {
+				replies[i] = password
+				continue
+			}
+			return nil, fmt.Errorf("no answer to the keyboard-interactive prompt %q", q)
+		}
+		return replies, nil
+	}
+}
+
+// normalizePrompt returns the prompt in lower case without surrounding space
+// and a trailing colon.
+func normalizePrompt(prompt string) string {
+	prompt = strings.TrimSpace(prompt)
+	prompt = strings.TrimSuffix(prompt, ":")
+	return strings.ToLower(strings.TrimSpace(prompt))
+}
@@ -0,0 +1,300 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestParseKey(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	assert.NoError(t, err)
+	plain := string(pem.EncodeToMemory(block))
+
+	block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("secret"))
+	assert.NoError(t, err)
+	encrypted := string(pem.EncodeToMemory(block))
+
+	signer, err := parseKey(plain, "")
+	assert.NoError(t, err)
+	assert.Equal(t, ssh.KeyAlgoED25519, signer.PublicKey().Type())
+
+	// a passphrase for an unencrypted key is not needed
+	_, err = parseKey(plain, "secret")
+	assert.NoError(t, err)
+
+	signer, err = parseKey(encrypted, "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, ssh.KeyAlgoED25519, signer.PublicKey().Type())
+
+	_, err = parseKey(encrypted, "")
+	assert.Equal(t, ErrKeyPassphraseMissing, err)
+
+	_, err = parseKey(encrypted, "wrong")
+	assert.Equal(t, ErrKeyPassphraseWrong, err)
+
+	_, err = parseKey(string(pem.EncodeToMemory(&pem.Block{Type: "UNKNOWN PRIVATE KEY", Bytes: []byte("key")})), "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported private key")
+}
+
+// helper function to generate a private key, returned as signer and PEM
+// encoded.
+func testKey(t *testing.T) (ed25519.PrivateKey, ssh.Signer, string) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	assert.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	assert.NoError(t, err)
+	return priv, signer, string(pem.EncodeToMemory(block))
+}
+
+// helper function to serve an SSH agent holding the key on a unix socket,
+// returning the path of the socket.
+func testAgent(t *testing.T, key ed25519.PrivateKey) string {
+	dir, err := ioutil.TempDir("", "agent")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	keyring := agent.NewKeyring()
+	assert.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: key}))
+
+	socket := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	return socket
+}
+
+func TestAuthMethods(t *testing.T) {
+	_, keySigner, key := testKey(t)
+	_, fileSigner, fileKey := testKey(t)
+	agentKey, agentSigner, _ := testKey(t)
+
+	keyPath := filepath.Join(t.TempDir(), "id_ed25519")
+	assert.NoError(t, ioutil.WriteFile(keyPath, []byte(fileKey), 0600))
+	socket := testAgent(t, agentKey)
+
+	// the server accepts the agent key only and records the offered keys
+	var mu sync.Mutex
+	var offered []string
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			fp := ssh.FingerprintSHA256(key)
+			if len(offered) == 0 || offered[len(offered)-1] != fp {
+				offered = append(offered, fp)
+			}
+			if fp == ssh.FingerprintSHA256(agentSigner.PublicKey()) {
+				return nil, nil
+			}
+			return nil, errors.New("denied")
+		},
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, errors.New("denied")
+		},
+	}
+	host, port, hostKey := newTestServer(t, config)
+
+	c, err := New(Config{
+		Server:       host,
+		Port:         port,
+		Username:     "drone",
+		Password:     "secret",
+		Key:          key,
+		KeyPath:      keyPath,
+		AgentSocket:  socket,
+		Fingerprints: []string{ssh.FingerprintSHA256(hostKey)},
+	})
+	assert.NoError(t, err)
+	defer c.(io.Closer).Close()
+
+	_, err = c.List(t.TempDir())
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		ssh.FingerprintSHA256(keySigner.PublicKey()),
+		ssh.FingerprintSHA256(fileSigner.PublicKey()),
+		ssh.FingerprintSHA256(agentSigner.PublicKey()),
+	}, offered)
+}
+
+func TestAuthMethodsAgentMissing(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "missing.sock")
+
+	_, _, err := authMethods(Config{AgentSocket: socket})
+	assert.Error(t, err)
+
+	// the other methods are used instead
+	auths, closer, err := authMethods(Config{AgentSocket: socket, Password: "secret"})
+	assert.NoError(t, err)
+	assert.Nil(t, closer)
+	assert.Len(t, auths, 2)
+
+	_, _, err = authMethods(Config{KeyPath: filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+}
+
+// helper function to sign a certificate for the key with the CA.
+func testCert(t *testing.T, key ssh.PublicKey, ca ssh.Signer, certType uint32, principals ...string) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        certType,
+		KeyId:           "test",
+		ValidPrincipals: principals,
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	assert.NoError(t, cert.SignCert(rand.Reader, ca))
+	return cert
+}
+
+func TestAuthCertificate(t *testing.T) {
+	_, ca, _ := testKey(t)
+	_, signer, key := testKey(t)
+	cert := string(ssh.MarshalAuthorizedKey(testCert(t, signer.PublicKey(), ca, ssh.UserCert, "drone")))
+
+	// the server only trusts certificates of the CA
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), ca.PublicKey().Marshal())
+		},
+	}
+	host, port, hostKey := newTestServer(t, &ssh.ServerConfig{
+		PublicKeyCallback: checker.Authenticate,
+	})
+
+	certPath := filepath.Join(t.TempDir(), "id_ed25519-cert.pub")
+	assert.NoError(t, ioutil.WriteFile(certPath, []byte(cert), 0600))
+
+	for _, cfg := range []Config{
+		{Key: key, Certificate: cert},
+		{Key: key, CertificatePath: certPath},
+	} {
+		cfg.Server, cfg.Port, cfg.Username = host, port, "drone"
+		cfg.Fingerprints = []string{ssh.FingerprintSHA256(hostKey)}
+
+		c, err := New(cfg)
+		assert.NoError(t, err)
+		if err == nil {
+			c.(io.Closer).Close()
+		}
+	}
+
+	// without the certificate the key is rejected
+	_, err := New(Config{
+		Server:       host,
+		Port:         port,
+		Username:     "drone",
+		Key:          key,
+		Fingerprints: []string{ssh.FingerprintSHA256(hostKey)},
+		Retry:        RetryPolicy{Attempts: 1},
+	})
+	assert.Error(t, err)
+}
+
+func TestAuthCertificateInvalid(t *testing.T) {
+	_, ca, _ := testKey(t)
+	_, signer, key := testKey(t)
+	_, other, _ := testKey(t)
+
+	_, _, err := authMethods(Config{
+		Key:         key,
+		Certificate: string(ssh.MarshalAuthorizedKey(testCert(t, other.PublicKey(), ca, ssh.UserCert))),
+	})
+	assert.Equal(t, ErrCertificateKeyMismatch, err)
+
+	_, _, err = authMethods(Config{
+		Key:         key,
+		Certificate: string(ssh.MarshalAuthorizedKey(testCert(t, signer.PublicKey(), ca, ssh.HostCert))),
+	})
+	assert.Error(t, err)
+
+	_, _, err = authMethods(Config{
+		Key:         key,
+		Certificate: string(ssh.MarshalAuthorizedKey(signer.PublicKey())),
+	})
+	assert.Error(t, err)
+
+	_, _, err = authMethods(Config{Key: key, Certificate: "garbage"})
+	assert.Error(t, err)
+}
+
+func TestKeyboardInteractive(t *testing.T) {
+	// the server rejects plain password authentication
+	host, port, hostKey := newTestServer(t, &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, errors.New("denied")
+		},
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := client(conn.User(), "", []string{"Password: ", "Verification code: "}, []bool{false, true})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) != 2 || answers[0] != "secret" || answers[1] != "123456" {
+				return nil, errors.New("denied")
+			}
+			return nil, nil
+		},
+	})
+
+	cfg := Config{
+		Server:       host,
+		Port:         port,
+		Username:     "drone",
+		Password:     "secret",
+		Prompts:      map[string]string{"verification code": "123456"},
+		Fingerprints: []string{ssh.FingerprintSHA256(hostKey)},
+		Retry:        RetryPolicy{Attempts: 1},
+	}
+	c, err := New(cfg)
+	if assert.NoError(t, err) {
+		c.(io.Closer).Close()
+	}
+
+	// unknown prompts are not answered
+	cfg.Prompts = nil
+	_, err = New(cfg)
+	assert.Error(t, err)
+}
+
+func TestChallenge(t *testing.T) {
+	answers, err := challenge("secret", map[string]string{"Password": "other", " PIN: ": "1234"})(
+		"drone", "", []string{"password:", "pin", "Password for drone@cache: "}, []bool{false, false, false})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other", "1234", "secret"}, answers)
+
+	answers, err = challenge("", nil)("drone", "instruction", nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, answers)
+
+	_, err = challenge("", nil)("drone", "", []string{"Password: "}, []bool{false})
+	assert.Error(t, err)
+}
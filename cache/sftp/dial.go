@@ -0,0 +1,283 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// defaultDialTimeout bounds connecting to a server unless configured.
+	defaultDialTimeout = 5 * time.Minute
+
+	// keepAliveMax is the number of keepalive requests in a row left
+	// unanswered before the connection is closed.
+	keepAliveMax = 3
+)
+
+// ErrIdleTimeout is returned for an operation which received no data from
+// the server within the idle timeout. The connection is considered lost.
+var ErrIdleTimeout = errors.New("no data received from the server within the idle timeout")
+
+// hop is an SSH server on the way to the cache server.
+type hop struct {
+	addr   string
+	config *ssh.ClientConfig
+}
+
+// newHop returns the hop to the server of the configuration, and the
+// connection to its SSH agent, if any, which is closed by the caller.
+func newHop(cfg Config) (hop, io.Closer, error) {
+	supported, insecure := ssh.SupportedAlgorithms(), ssh.InsecureAlgorithms()
+	for _, algos := range []struct {
+		kind             string
+		names            []string
+		supported, extra []string
+	}{
+		{"cipher", cfg.Ciphers, supported.Ciphers, insecure.Ciphers},
+		{"key exchange", cfg.KeyExchanges, supported.KeyExchanges, insecure.KeyExchanges},
+		{"MAC", cfg.MACs, supported.MACs, insecure.MACs},
+		{"host key algorithm", cfg.HostKeyAlgorithms, supported.HostKeys, insecure.HostKeys},
+	} {
+		for _, name := range algos.names {
+			if !contains(algos.supported, name) && !contains(algos.extra, name) {
+				return hop{}, nil, fmt.Errorf("unsupported %s %q", algos.kind, name)
+			}
+		}
+	}
+
+	auths, agent, err := authMethods(cfg)
+	if err != nil {
+		return hop{}, nil, err
+	}
+
+	hostKey, err := hostKeyCallback(cfg)
+	if err != nil {
+		if agent != nil {
+			agent.Close()
+		}
+		return hop{}, nil, err
+	}
+
+	port := cfg.Port
+	if port == "" {
+		port = "22"
+	}
+	timeout := cfg.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+
+	return hop{
+		addr: net.JoinHostPort(cfg.Server, port),
+		config: &ssh.ClientConfig{
+			Config: ssh.Config{
+				Ciphers:      cfg.Ciphers,
+				KeyExchanges: cfg.KeyExchanges,
+				MACs:         cfg.MACs,
+			},
+			Timeout:           timeout,
+			User:              cfg.Username,
+			Auth:              auths,
+			HostKeyCallback:   hostKey,
+			HostKeyAlgorithms: cfg.HostKeyAlgorithms,
+		},
+	}, agent, nil
+}
+
+// contains reports whether the list contains s.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// dial connects to the last of the hops, tunneling the connection through
+// the ones before it like the ProxyJump option of ssh. The first hop is
+// connected to with the dialer. Data received from the last hop is recorded
+// in the activity. The connections to the jump hosts are closed along with
+// the returned client.
+func dial(dialer proxy.ContextDialer, hops []hop, a *activity) (*ssh.Client, error) {
+	var jumps []*ssh.Client
+	closeJumps := func() {
+		for i := len(jumps) - 1; i >= 0; i-- {
+			jumps[i].Close()
+		}
+	}
+
+	var client *ssh.Client
+	for i, h := range hops {
+		var conn net.Conn
+		var err error
+		if client == nil {
+			conn, err = dialFirst(dialer, h)
+		} else {
+			jumps = append(jumps, client)
+			conn, err = client.Dial("tcp", h.addr)
+		}
+		if err != nil {
+			closeJumps()
+			// a tunnel failing is reported by the jump host opening it
+			if i > 0 {
+				i--
+			}
+			return nil, jumpError(hops, i, err)
+		}
+
+		if i == len(hops)-1 && a != nil {
+			conn = &activityConn{Conn: conn, a: a}
+		}
+
+		c, chans, reqs, err := ssh.NewClientConn(conn, h.addr, h.config)
+		if err != nil {
+			conn.Close()
+			closeJumps()
+			return nil, jumpError(hops, i, err)
+		}
+		client = ssh.NewClient(c, chans, reqs)
+	}
+
+	if len(jumps) > 0 {
+		go func() {
+			client.Wait()
+			closeJumps()
+		}()
+	}
+	return client, nil
+}
+
+// dialFirst connects to the first hop with the dialer, bound by its timeout.
+func dialFirst(dialer proxy.ContextDialer, h hop) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+	return dialer.DialContext(ctx, "tcp", h.addr)
+}
+
+// jumpError names the jump host hops[i] in err, errors of the cache server
+// itself are returned as is.
+func jumpError(hops []hop, i int, err error) error {
+	if i == len(hops)-1 {
+		return err
+	}
+	return fmt.Errorf("jump host %s: %w", hops[i].addr, err)
+}
+
+// keepAlive sends a keepalive request over the connection every interval
+// until it is closed, and closes it when keepAliveMax requests in a row are
+// left unanswered.
+func keepAlive(client *ssh.Client, interval time.Duration) {
+	closed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	var missed int32
+	for {
+		select {
+		case <-closed:
+			return
+		case <-t.C:
+		}
+
+		if atomic.AddInt32(&missed, 1) > keepAliveMax {
+			client.Close()
+			return
+		}
+		go func() {
+			// any reply, even a refusal, shows the server is alive
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+				atomic.StoreInt32(&missed, 0)
+			}
+		}()
+	}
+}
+
+// activity records when data was last received from the server.
+type activity struct {
+	last int64
+}
+
+// touch records data received now.
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// idle returns the time since data was last received, counted from start at
+// the earliest.
+func (a *activity) idle(start time.Time) time.Duration {
+	last := time.Unix(0, atomic.LoadInt64(&a.last))
+	if last.Before(start) {
+		last = start
+	}
+	return time.Since(last)
+}
+
+// activityConn is a connection recording the data read in the activity.
+type activityConn struct {
+	net.Conn
+	a *activity
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.a.touch()
+	}
+	return n, err
+}
+
+// watch calls fn, an operation of the session s. When no data is received
+// from the server for the idle timeout meanwhile the connection is closed,
+// failing the operation with ErrIdleTimeout instead of hanging.
+func (c *cacher) watch(s *sftp.Client, fn func() error) error {
+	if c.idleTimeout <= 0 || c.activity == nil {
+		return fn()
+	}
+
+	interval := c.idleTimeout / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+
+	start := time.Now()
+	done := make(chan struct{})
+	var expired int32
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			if c.activity.idle(start) > c.idleTimeout {
+				atomic.StoreInt32(&expired, 1)
+				c.expire(s)
+				return
+			}
+		}
+	}()
+
+	err := fn()
+	close(done)
+	if err != nil && atomic.LoadInt32(&expired) == 1 {
+		return ErrIdleTimeout
+	}
+	return err
+}
@@ -0,0 +1,236 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// helper function to start a test server accepting the password, counting
+// the logins.
+func testPasswordServer(t *testing.T, password string) (Config, *int32) {
+	logins := new(int32)
+	host, port, hostKey := newTestServer(t, &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, p []byte) (*ssh.Permissions, error) {
+			if string(p) != password {
+				return nil, errors.New("denied")
+			}
+			atomic.AddInt32(logins, 1)
+			return nil, nil
+		},
+	})
+	return Config{
+		Server:       host,
+		Port:         port,
+		Username:     "drone",
+		Password:     password,
+		Fingerprints: []string{ssh.FingerprintSHA256(hostKey)},
+	}, logins
+}
+
+func TestJumps(t *testing.T) {
+	first, firstLogins := testPasswordServer(t, "first")
+	second, secondLogins := testPasswordServer(t, "second")
+	cfg, logins := testPasswordServer(t, "cache")
+
+	cfg.Jumps = []Config{first, second}
+	c, err := New(cfg)
+	assert.NoError(t, err)
+	defer c.(io.Closer).Close()
+
+	_, err = c.List(t.TempDir())
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(firstLogins))
+	assert.Equal(t, int32(1), atomic.LoadInt32(secondLogins))
+	assert.Equal(t, int32(1), atomic.LoadInt32(logins))
+}
+
+func TestJumpsFailing(t *testing.T) {
+	first, _ := testPasswordServer(t, "first")
+	cfg, _ := testPasswordServer(t, "cache")
+	cfg.Retry = RetryPolicy{Attempts: 1}
+
+	// the jump host rejects the login
+	jump := first
+	jump.Password = "wrong"
+	cfg.Jumps = []Config{jump}
+	_, err := New(cfg)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "jump host "+net.JoinHostPort(first.Server, first.Port))
+
+	// the jump host can not reach the server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	unreachable := cfg
+	unreachable.Server, unreachable.Port, _ = net.SplitHostPort(l.Addr().String())
+	l.Close()
+	unreachable.Jumps = []Config{first}
+	_, err = New(unreachable)
+	assert.Error(t, err)
+
+	// the jump host settings are validated
+	jump = first
+	jump.Fingerprints = nil
+	cfg.Jumps = []Config{jump}
+	_, err = New(cfg)
+	assert.Error(t, err)
+}
+
+// helper function to forward connections to the server of the config. It
+// returns the config connecting through the forwarder, and a function
+// silently dropping the data of the connections forwarded so far, like a
+// NAT box which forgot them.
+func newTestForwarder(t *testing.T, cfg Config) (Config, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	addr := net.JoinHostPort(cfg.Server, cfg.Port)
+	var mu sync.Mutex
+	var dropped []*int32
+	forward := func(dst, src net.Conn, drop *int32) {
+		defer dst.Close()
+		b := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(b)
+			if err != nil {
+				return
+			}
+			if atomic.LoadInt32(drop) == 0 {
+				dst.Write(b[:n])
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			dest, err := net.Dial("tcp", addr)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			drop := new(int32)
+			mu.Lock()
+			dropped = append(dropped, drop)
+			mu.Unlock()
+			go forward(dest, conn, drop)
+			go forward(conn, dest, drop)
+		}
+	}()
+
+	cfg.Server, cfg.Port, _ = net.SplitHostPort(l.Addr().String())
+	return cfg, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, drop := range dropped {
+			atomic.StoreInt32(drop, 1)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	server, _ := testPasswordServer(t, "cache")
+	cfg, drop := newTestForwarder(t, server)
+	cfg.IdleTimeout = 200 * time.Millisecond
+	cfg.Retry = RetryPolicy{Attempts: 2}
+
+	c, err := New(cfg)
+	assert.NoError(t, err)
+	defer c.(io.Closer).Close()
+
+	// the operation on the dropped connection times out and is retried on
+	// a new one
+	drop()
+	start := time.Now()
+	_, err = c.List(t.TempDir())
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestKeepAlive(t *testing.T) {
+	server, _ := testPasswordServer(t, "cache")
+	cfg, drop := newTestForwarder(t, server)
+	cfg.KeepAlive = 20 * time.Millisecond
+
+	c, err := New(cfg)
+	assert.NoError(t, err)
+	defer c.(io.Closer).Close()
+	closed := make(chan struct{})
+	go func() {
+		c.(*cacher).ssh.Wait()
+		close(closed)
+	}()
+
+	// answered keepalives keep the connection open
+	select {
+	case <-closed:
+		t.Fatal("connection closed while the server answers")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// unanswered ones close it
+	drop()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed after unanswered keepalives")
+	}
+}
+
+type blockingDialer struct{}
+
+func (blockingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestDialTimeout(t *testing.T) {
+	start := time.Now()
+	_, err := dialFirst(blockingDialer{}, hop{
+		addr:   "192.0.2.1:22",
+		config: &ssh.ClientConfig{Timeout: 50 * time.Millisecond},
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestAlgorithms(t *testing.T) {
+	cfg, _ := testPasswordServer(t, "cache")
+	cfg.Ciphers = []string{"aes256-gcm@openssh.com"}
+	cfg.KeyExchanges = []string{"curve25519-sha256"}
+	cfg.MACs = []string{"hmac-sha2-256-etm@openssh.com"}
+	cfg.HostKeyAlgorithms = []string{ssh.KeyAlgoED25519}
+
+	c, err := New(cfg)
+	if assert.NoError(t, err) {
+		c.(io.Closer).Close()
+	}
+
+	// no algorithm in common with the server
+	cfg.Retry = RetryPolicy{Attempts: 1}
+	cfg.HostKeyAlgorithms = []string{ssh.KeyAlgoRSASHA256}
+	_, err = New(cfg)
+	assert.Error(t, err)
+
+	for _, cfg := range []Config{
+		{Ciphers: []string{"blowfish-cbc"}},
+		{KeyExchanges: []string{"diffie-hellman-group99"}},
+		{MACs: []string{"hmac-md5"}},
+		{HostKeyAlgorithms: []string{"ssh-foo"}},
+	} {
+		_, _, err := newHop(cfg)
+		assert.Error(t, err)
+	}
+}
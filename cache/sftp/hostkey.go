@@ -0,0 +1,142 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ErrNoHostKeyVerification is returned when no way to verify the host key of
+// the server is configured and verification is not disabled explicitly.
+var ErrNoHostKeyVerification = errors.New("missing host key verification, set known hosts, fingerprints or host CAs, or disable it explicitly")
+
+// hostKeyCallback returns the callback verifying the host key of the server
+// against the known hosts, fingerprints and host CAs of the configuration. A
+// key is accepted when its fingerprint is listed or the known hosts list it
+// for the server. A host certificate signed by one of the host CAs is
+// accepted when it is valid for the server, the key of other certificates is
+// checked like a plain key.
+func hostKeyCallback(cfg Config) (ssh.HostKeyCallback, error) {
+	if cfg.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	fingerprints := map[string]bool{}
+	for _, fp := range cfg.Fingerprints {
+		if fp = strings.TrimSpace(fp); fp == "" {
+			continue
+		}
+		if !strings.HasPrefix(fp, "SHA256:") {
+			fp = "SHA256:" + fp
+		}
+		fingerprints[strings.TrimRight(fp, "=")] = true
+	}
+
+	known, err := knownHosts(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	authorities, err := hostAuthorities(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if known == nil && len(fingerprints) == 0 && len(authorities) == 0 {
+		return nil, ErrNoHostKeyVerification
+	}
+
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return authorities[string(auth.Marshal())]
+		},
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		plain := key
+		cert, isCert := key.(*ssh.Certificate)
+		if isCert {
+			if authorities[string(cert.SignatureKey.Marshal())] {
+				if err := checker.CheckHostKey(hostname, remote, key); err != nil {
+					return fmt.Errorf("host certificate %s of %s: %v", ssh.FingerprintSHA256(key), hostname, err)
+				}
+				return nil
+			}
+
+			// servers with a host certificate present it first, like ssh
+			// the key it certifies is verified without it
+			plain = cert.Key
+		}
+
+		fp := ssh.FingerprintSHA256(plain)
+		if fingerprints[fp] {
+			return nil
+		}
+		if known != nil {
+			// the known hosts may list the CA of the certificate
+			if isCert && known(hostname, remote, key) == nil {
+				return nil
+			}
+			if err := known(hostname, remote, plain); err != nil {
+				return fmt.Errorf("host key %s %s of %s: %v", plain.Type(), fp, hostname, err)
+			}
+			return nil
+		}
+		return fmt.Errorf("host key %s %s of %s does not match the fingerprints or host CAs", plain.Type(), fp, hostname)
+	}, nil
+}
+
+// hostAuthorities returns the set of marshaled host CA keys of the
+// configuration.
+func hostAuthorities(cfg Config) (map[string]bool, error) {
+	authorities := map[string]bool{}
+	for _, ca := range cfg.HostCAs {
+		if strings.TrimSpace(ca) == "" {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(ca))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the host CA %q: %v", ca, err)
+		}
+		authorities[string(key.Marshal())] = true
+	}
+	return authorities, nil
+}
+
+// knownHosts returns the callback checking the known hosts content and file
+// of the configuration, or nil if neither is set.
+func knownHosts(cfg Config) (ssh.HostKeyCallback, error) {
+	var files []string
+	if cfg.KnownHostsFile != "" {
+		files = append(files, cfg.KnownHostsFile)
+	}
+
+	// the knownhosts package only reads files
+	if strings.TrimSpace(cfg.KnownHosts) != "" {
+		f, err := ioutil.TempFile("", "known_hosts")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+
+		_, err = f.WriteString(cfg.KnownHosts + "\n")
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f.Name())
+	}
+
+	if len(files) == 0 {
+		return nil, nil
+	}
+	return knownhosts.New(files...)
+}
@@ -0,0 +1,153 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// helper function to generate a host key.
+func testHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	assert.NoError(t, err)
+	return key
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	key, other := testHostKey(t), testHostKey(t)
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2222}
+	line := knownhosts.Line([]string{"cache.example.com:2222"}, key)
+
+	file, err := ioutil.TempFile("", "known_hosts")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(line + "\n")
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"known hosts", Config{KnownHosts: line}},
+		{"known hosts file", Config{KnownHostsFile: file.Name()}},
+		{"fingerprint", Config{Fingerprints: []string{ssh.FingerprintSHA256(key)}}},
+		{"fingerprint without prefix", Config{Fingerprints: []string{strings.TrimPrefix(ssh.FingerprintSHA256(key), "SHA256:")}}},
+		{"fingerprint and known hosts", Config{
+			KnownHosts:   knownhosts.Line([]string{"cache.example.com:2222"}, other),
+			Fingerprints: []string{ssh.FingerprintSHA256(key)},
+		}},
+	}
+
+	for _, tt := range tests {
+		cb, err := hostKeyCallback(tt.cfg)
+		assert.NoError(t, err, tt.name)
+		assert.NoError(t, cb("cache.example.com:2222", remote, key), tt.name)
+
+		err = cb("cache.example.com:2222", remote, testHostKey(t))
+		assert.Error(t, err, tt.name)
+	}
+
+	// the known hosts are checked for the server
+	cb, err := hostKeyCallback(Config{KnownHosts: line})
+	assert.NoError(t, err)
+	assert.Error(t, cb("other.example.com:22", remote, key))
+}
+
+func TestHostKeyCallbackRequired(t *testing.T) {
+	_, err := hostKeyCallback(Config{})
+	assert.Equal(t, ErrNoHostKeyVerification, err)
+
+	_, err = hostKeyCallback(Config{Fingerprints: []string{" "}})
+	assert.Equal(t, ErrNoHostKeyVerification, err)
+
+	cb, err := hostKeyCallback(Config{InsecureIgnoreHostKey: true})
+	assert.NoError(t, err)
+	assert.NoError(t, cb("cache.example.com:22", &net.TCPAddr{}, testHostKey(t)))
+
+	_, err = hostKeyCallback(Config{KnownHostsFile: "/does/not/exist"})
+	assert.Error(t, err)
+}
+
+func TestHostKeyCallbackCertificate(t *testing.T) {
+	_, ca, _ := testKey(t)
+	_, other, _ := testKey(t)
+	key := testHostKey(t)
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2222}
+	authority := string(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+
+	cb, err := hostKeyCallback(Config{HostCAs: []string{authority}})
+	assert.NoError(t, err)
+
+	assert.NoError(t, cb("cache.example.com:2222", remote, testCert(t, key, ca, ssh.HostCert, "cache.example.com")))
+
+	// the certificate must be valid for the server
+	assert.Error(t, cb("cache.example.com:2222", remote, testCert(t, key, ca, ssh.HostCert, "other.example.com")))
+	assert.Error(t, cb("cache.example.com:2222", remote, testCert(t, key, ca, ssh.UserCert, "cache.example.com")))
+
+	// it must be signed by a host CA
+	assert.Error(t, cb("cache.example.com:2222", remote, testCert(t, key, other, ssh.HostCert, "cache.example.com")))
+	assert.Error(t, cb("cache.example.com:2222", remote, key))
+
+	// plain host keys are still checked against the known hosts
+	cb, err = hostKeyCallback(Config{
+		HostCAs:    []string{authority},
+		KnownHosts: knownhosts.Line([]string{"cache.example.com:2222"}, key),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, cb("cache.example.com:2222", remote, key))
+
+	_, err = hostKeyCallback(Config{HostCAs: []string{"garbage"}})
+	assert.Error(t, err)
+}
+
+func TestHostCertificateWithoutCA(t *testing.T) {
+	_, ca, _ := testKey(t)
+	_, signer, _ := testKey(t)
+	cert := testCert(t, signer.PublicKey(), ca, ssh.HostCert, "127.0.0.1")
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	assert.NoError(t, err)
+
+	// the server presents the certificate before its plain host keys
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(certSigner)
+	host, port, _ := newTestServer(t, config)
+	line := knownhosts.Line([]string{net.JoinHostPort(host, port)}, signer.PublicKey())
+
+	for _, cfg := range []Config{
+		{Fingerprints: []string{ssh.FingerprintSHA256(signer.PublicKey())}},
+		{KnownHosts: line},
+	} {
+		cfg.Server, cfg.Port, cfg.Username = host, port, "drone"
+		cfg.Password = "password"
+		cfg.Retry = RetryPolicy{Attempts: 1}
+
+		c, err := New(cfg)
+		assert.NoError(t, err)
+		if err == nil {
+			c.(io.Closer).Close()
+		}
+	}
+
+	// a certificate of another key is still rejected
+	_, err = New(Config{
+		Server:       host,
+		Port:         port,
+		Username:     "drone",
+		Password:     "password",
+		Fingerprints: []string{ssh.FingerprintSHA256(testHostKey(t))},
+		Retry:        RetryPolicy{Attempts: 1},
+	})
+	assert.Error(t, err)
+}
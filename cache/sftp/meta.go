@@ -0,0 +1,70 @@
+package sftp
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/appleboy/drone-sftp-cache/cache"
+	"github.com/pkg/sftp"
+)
+
+// readMeta returns the metadata stored for the cache entry p. A missing
+// metadata file is the same as empty metadata, see cache.ParseMetadata.
+func (c *cacher) readMeta(p string) (*cache.Metadata, error) {
+	var m *cache.Metadata
+	err := c.do(func(s *sftp.Client) error {
+		m = new(cache.Metadata)
+
+		f, err := s.Open(p + cache.MetaSuffix)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		m = cache.ParseMetadata(b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeMeta stores the metadata for the cache entry p.
+func (c *cacher) writeMeta(p string, m *cache.Metadata) error {
+	b, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+
+	return c.do(func(s *sftp.Client) error {
+		f, err := s.Create(p + cache.MetaSuffix)
+		if err != nil {
+			return err
+		}
+
+		if _, err := f.Write(b); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	})
+}
+
+// removeMeta removes the metadata stored for the cache entry p, if any.
+func (c *cacher) removeMeta(p string) error {
+	return c.do(func(s *sftp.Client) error {
+		err := s.Remove(p + cache.MetaSuffix)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+}
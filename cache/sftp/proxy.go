@@ -0,0 +1,147 @@
+package sftp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ErrInvalidProxy is returned for a proxy which is not a valid URL. The URL
+// is not included, it may contain the proxy password.
+var ErrInvalidProxy = errors.New("invalid proxy URL, expected socks5://, socks5h://, http:// or https://host:port")
+
+// proxyDialer returns the dialer connecting to the first hop through the
+// proxy of the configuration, or the one of the ALL_PROXY or HTTPS_PROXY
+// environment variables if it is not set. Servers listed in NO_PROXY are
+// dialed directly when the proxy is taken from the environment.
+func proxyDialer(cfg Config) (proxy.ContextDialer, error) {
+	raw := cfg.Proxy
+	env := raw == ""
+	if env {
+		raw = getenv("ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy")
+	}
+	if raw == "" {
+		return proxy.Direct, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, ErrInvalidProxy
+	}
+
+	var dialer proxy.Dialer
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		if dialer, err = proxy.FromURL(u, proxy.Direct); err != nil {
+			return nil, err
+		}
+	case "http", "https":
+		dialer = &httpProxy{url: u}
+	default:
+		return nil, ErrInvalidProxy
+	}
+
+	if noProxy := getenv("NO_PROXY", "no_proxy"); env && noProxy != "" {
+		perHost := proxy.NewPerHost(dialer, proxy.Direct)
+		perHost.AddFromString(noProxy)
+		dialer = perHost
+	}
+	return dialer.(proxy.ContextDialer), nil
+}
+
+// getenv returns the first of the environment variables which is set.
+func getenv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// httpProxy dials through an HTTP proxy with the CONNECT method.
+type httpProxy struct {
+	url *url.URL
+}
+
+// Dial connects to the address through the proxy.
+func (p *httpProxy) Dial(network, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the address through the proxy.
+func (p *httpProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host := p.url.Host
+	if p.url.Port() == "" {
+		port := "80"
+		if p.url.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(p.url.Hostname(), port)
+	}
+
+	conn, err := proxy.Direct.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if p.url.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: p.url.Hostname()})
+	}
+
+	// the handshake with the proxy is bound by the context as well
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user := p.url.User; user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", p.url.Host, addr, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+// bufferedConn is a connection whose reads are buffered, keeping the data
+// the server sent right after the proxy response.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
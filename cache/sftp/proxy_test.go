@@ -0,0 +1,215 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// helper function to copy between the connections until either is closed.
+func pipeTestConns(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+	go io.Copy(a, b)
+	io.Copy(b, a)
+}
+
+// helper function to start a SOCKS5 proxy requiring the user and password,
+// counting the connections it forwards. It returns the address of the proxy.
+func newTestSOCKS5Proxy(t *testing.T, user, password string) (string, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	forwarded := new(int32)
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+
+		// method negotiation, only username and password are accepted
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(conn, head); err != nil {
+			return
+		}
+		methods := make([]byte, head[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+		conn.Write([]byte{5, 2})
+
+		// username and password authentication
+		if _, err := io.ReadFull(conn, head); err != nil {
+			return
+		}
+		u := make([]byte, head[1])
+		io.ReadFull(conn, u)
+		plen := make([]byte, 1)
+		io.ReadFull(conn, plen)
+		p := make([]byte, plen[0])
+		io.ReadFull(conn, p)
+		if string(u) != user || string(p) != password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+
+		// connect request
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(conn, req); err != nil || req[1] != 1 {
+			return
+		}
+		var host string
+		switch req[3] {
+		case 1:
+			ip := make([]byte, 4)
+			io.ReadFull(conn, ip)
+			host = net.IP(ip).String()
+		case 3:
+			n := make([]byte, 1)
+			io.ReadFull(conn, n)
+			name := make([]byte, n[0])
+			io.ReadFull(conn, name)
+			host = string(name)
+		default:
+			return
+		}
+		port := make([]byte, 2)
+		io.ReadFull(conn, port)
+
+		dest, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+		if err != nil {
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		atomic.AddInt32(forwarded, 1)
+		pipeTestConns(conn, dest)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return l.Addr().String(), forwarded
+}
+
+// helper function to start an HTTP proxy requiring the basic authorization,
+// counting the connections it forwards. It returns the address of the proxy.
+func newTestHTTPProxy(t *testing.T, auth string) (string, *int32) {
+	forwarded := new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != auth {
+			http.Error(w, "denied", http.StatusProxyAuthRequired)
+			return
+		}
+
+		dest, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			dest.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		atomic.AddInt32(forwarded, 1)
+		pipeTestConns(conn, dest)
+	}))
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String(), forwarded
+}
+
+func TestProxy(t *testing.T) {
+	socks, socksForwarded := newTestSOCKS5Proxy(t, "drone", "secret")
+	httpProxy, httpForwarded := newTestHTTPProxy(t, "Basic ZHJvbmU6c2VjcmV0")
+
+	tests := []struct {
+		proxy     string
+		forwarded *int32
+	}{
+		{"socks5://drone:secret@" + socks, socksForwarded},
+		{"socks5h://drone:secret@" + socks, socksForwarded},
+		{"http://drone:secret@" + httpProxy, httpForwarded},
+	}
+
+	for _, tt := range tests {
+		cfg, logins := testPasswordServer(t, "cache")
+		cfg.Proxy = tt.proxy
+		before := atomic.LoadInt32(tt.forwarded)
+
+		c, err := New(cfg)
+		if assert.NoError(t, err, tt.proxy) {
+			_, err = c.List(t.TempDir())
+			assert.NoError(t, err, tt.proxy)
+			c.(io.Closer).Close()
+		}
+		assert.Equal(t, before+1, atomic.LoadInt32(tt.forwarded), tt.proxy)
+		assert.Equal(t, int32(1), atomic.LoadInt32(logins), tt.proxy)
+	}
+
+	// the proxy credentials are checked
+	for _, proxy := range []string{
+		"socks5://drone:wrong@" + socks,
+		"http://drone:wrong@" + httpProxy,
+	} {
+		cfg, _ := testPasswordServer(t, "cache")
+		cfg.Proxy = proxy
+		cfg.Retry = RetryPolicy{Attempts: 1}
+		_, err := New(cfg)
+		assert.Error(t, err, proxy)
+	}
+}
+
+func TestProxyEnvironment(t *testing.T) {
+	socks, forwarded := newTestSOCKS5Proxy(t, "drone", "secret")
+	cfg, _ := testPasswordServer(t, "cache")
+
+	t.Setenv("ALL_PROXY", "")
+	t.Setenv("all_proxy", "")
+	t.Setenv("HTTPS_PROXY", "socks5://drone:secret@"+socks)
+	t.Setenv("NO_PROXY", "")
+	t.Setenv("no_proxy", "")
+
+	c, err := New(cfg)
+	if assert.NoError(t, err) {
+		c.(io.Closer).Close()
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(forwarded))
+
+	// servers listed in NO_PROXY are dialed directly
+	t.Setenv("NO_PROXY", cfg.Server)
+	c, err = New(cfg)
+	if assert.NoError(t, err) {
+		c.(io.Closer).Close()
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(forwarded))
+}
+
+func TestProxyInvalid(t *testing.T) {
+	for _, proxy := range []string{
+		"ftp://proxy:21",
+		"proxy:1080",
+		"http://",
+		"://user:secret@proxy",
+	} {
+		_, err := proxyDialer(Config{Proxy: proxy})
+		assert.Equal(t, ErrInvalidProxy, err, proxy)
+	}
+}
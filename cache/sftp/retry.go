@@ -0,0 +1,141 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// maxDelay caps the wait between two attempts.
+const maxDelay = 2 * time.Minute
+
+// RetryPolicy defines how operations failing with transient errors, like a
+// lost connection, are retried. Permanent errors like a missing file or
+// denied permission are never retried.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts of an operation, values
+	// below one mean a single attempt.
+	Attempts int
+
+	// Delay is the wait before the first retry, it doubles with every
+	// further retry.
+	Delay time.Duration
+
+	// Jitter is the fraction of the delay, between 0 and 1, added to or
+	// subtracted from it at random, so clients failing at the same time do
+	// not retry at the same time.
+	Jitter float64
+}
+
+// attempts returns the maximum number of attempts of an operation.
+func (r RetryPolicy) attempts() int {
+	if r.Attempts < 1 {
+		return 1
+	}
+	return r.Attempts
+}
+
+// backoff returns the wait after the failed attempt n.
+func (r RetryPolicy) backoff(n int) time.Duration {
+	d := r.Delay
+	for i := 1; i < n && d < maxDelay; i++ {
+		d *= 2
+	}
+	if d > maxDelay {
+		d = maxDelay
+	}
+
+	jitter := r.Jitter
+	if jitter > 1 {
+		jitter = 1
+	}
+	if jitter > 0 {
+		d += time.Duration(jitter * float64(d) * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// retry calls fn until it succeeds, fails with a permanent error or the
+// attempts of the policy are used up, and returns its last error.
+func (r RetryPolicy) retry(fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !transient(err) || attempt >= r.attempts() {
+			return err
+		}
+		time.Sleep(r.backoff(attempt))
+	}
+}
+
+// transient reports whether an operation failing with err may succeed when
+// it is retried.
+func transient(err error) bool {
+	if lost(err) {
+		return true
+	}
+
+	// generic failures include temporary server problems like a full disk,
+	// the specific codes are permanent
+	var status *sftp.StatusError
+	if errors.As(err, &status) {
+		return status.FxCode() == sftp.ErrSSHFxFailure
+	}
+	if errors.Is(err, sftp.ErrSSHFxFailure) {
+		return true
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.Temporary() || dnsErr.Timeout()
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// lost reports whether err is caused by a broken connection, which has to be
+// established again before retrying.
+func lost(err error) bool {
+	if closed(err) {
+		return true
+	}
+	for _, target := range []error{
+		io.ErrUnexpectedEOF,
+		net.ErrClosed,
+		ErrIdleTimeout,
+		sftp.ErrSSHFxConnectionLost,
+		sftp.ErrSSHFxNoConnection,
+		syscall.ECONNRESET,
+		syscall.ECONNABORTED,
+		syscall.EPIPE,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	var status *sftp.StatusError
+	if errors.As(err, &status) {
+		code := status.FxCode()
+		return code == sftp.ErrSSHFxConnectionLost || code == sftp.ErrSSHFxNoConnection
+	}
+	return false
+}
+
+// closed reports whether err is the end of a closed connection. The sftp
+// package returns the end of a file or directory as a bare io.EOF, also
+// inside an *os.PathError, while the io.EOF of the connection is wrapped by
+// the failed request.
+func closed(err error) bool {
+	if !errors.Is(err, io.EOF) || err == io.EOF {
+		return false
+	}
+	var pathErr *os.PathError
+	return !errors.As(err, &pathErr) || pathErr.Err != io.EOF
+}
@@ -0,0 +1,86 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransient(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+		lost      bool
+	}{
+		{io.EOF, false, false},
+		{&os.PathError{Op: "open", Path: "archive", Err: io.EOF}, false, false},
+		{fmt.Errorf("failed to send packet: %w", io.EOF), true, true},
+		{sftp.ErrSSHFxConnectionLost, true, true},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, true, true},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true, false},
+		{&sftp.StatusError{Code: uint32(sftp.ErrSSHFxFailure)}, true, false},
+		{&sftp.StatusError{Code: uint32(sftp.ErrSSHFxPermissionDenied)}, false, false},
+		{&os.PathError{Op: "open", Path: "archive", Err: os.ErrNotExist}, false, false},
+		{os.ErrPermission, false, false},
+		{&net.DNSError{Err: "no such host", Name: "example", IsNotFound: true}, false, false},
+		{errors.New("ssh: unable to authenticate"), false, false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.transient, transient(tt.err), "transient %v", tt.err)
+		assert.Equal(t, tt.lost, lost(tt.err), "lost %v", tt.err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	r := RetryPolicy{Delay: time.Second}
+	assert.Equal(t, time.Second, r.backoff(1))
+	assert.Equal(t, 2*time.Second, r.backoff(2))
+	assert.Equal(t, 8*time.Second, r.backoff(4))
+	assert.Equal(t, maxDelay, r.backoff(100))
+
+	r.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := r.backoff(2)
+		assert.True(t, d >= time.Second && d <= 3*time.Second, "backoff %v", d)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	r := RetryPolicy{Attempts: 3}
+
+	var calls int
+	err := r.retry(func() error {
+		calls++
+		return io.ErrUnexpectedEOF
+	})
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, 3, calls)
+
+	// permanent errors are not retried
+	calls = 0
+	err = r.retry(func() error {
+		calls++
+		return os.ErrNotExist
+	})
+	assert.Equal(t, os.ErrNotExist, err)
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	err = r.retry(func() error {
+		if calls++; calls < 2 {
+			return sftp.ErrSSHFxConnectionLost
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,125 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// helper function to start an SSH server on a local port, authenticating
+// clients with the config and serving the sftp subsystem on the local file
+// system, and forwarding direct-tcpip channels like a jump host. It returns
+// the host and port of the server and its host key.
+func newTestServer(t testing.TB, config *ssh.ServerConfig) (string, string, ssh.PublicKey) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestConn(conn, config)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	return host, port, hostKey.PublicKey()
+}
+
+// helper function to serve the sftp subsystem over the SSH connection.
+func serveTestConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+
+	sc, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer sc.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() == "direct-tcpip" {
+			go forwardTestChannel(nc)
+			continue
+		}
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			for req := range reqs {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				go func() {
+					defer ch.Close()
+					if server, err := sftp.NewServer(ch); err == nil {
+						server.Serve()
+					}
+				}()
+			}
+		}()
+	}
+}
+
+// helper function to forward the direct-tcpip channel to its destination.
+func forwardTestChannel(nc ssh.NewChannel) {
+	var dest struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &dest); err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(dest.Host, strconv.Itoa(int(dest.Port))))
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		io.Copy(conn, ch)
+		conn.Close()
+	}()
+	io.Copy(ch, conn)
+}
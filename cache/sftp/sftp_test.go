@@ -0,0 +1,194 @@
+package sftp
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/appleboy/drone-sftp-cache/cache"
+	"github.com/appleboy/drone-sftp-cache/cache/cachetest"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// helper function to return a cacher connected to an in-process SFTP server
+// serving the local file system, and a temporary directory to use as root.
+func newTestCacher(t testing.TB) (*cacher, string) {
+	return newLatencyCacher(t, 0)
+}
+
+// helper function to return a test cacher whose messages to and from the
+// server are delayed by the latency.
+func newLatencyCacher(t testing.TB, latency time.Duration) (*cacher, string) {
+	dir, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var servers []*sftp.Server
+	var clients []*sftp.Client
+
+	// every connection is served by its own in-process server
+	connect := func() (*ssh.Client, []*sftp.Client, error) {
+		cr, sw := delayed(latency)
+		sr, cw := delayed(latency)
+
+		server, err := sftp.NewServer(struct {
+			io.Reader
+			io.WriteCloser
+		}{sr, sw})
+		if err != nil {
+			return nil, nil, err
+		}
+		go server.Serve()
+
+		client, err := sftp.NewClientPipe(cr, cw)
+		if err != nil {
+			server.Close()
+			return nil, nil, err
+		}
+		servers = append(servers, server)
+		clients = append(clients, client)
+		testServers.Store(client, server)
+		return nil, []*sftp.Client{client}, nil
+	}
+
+	_, sessions, err := connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		for i := range servers {
+			servers[i].Close()
+			clients[i].Close()
+		}
+		os.RemoveAll(dir)
+	})
+	return &cacher{
+		sessions:    sessions,
+		connect:     connect,
+		retry:       RetryPolicy{Attempts: 3},
+		concurrency: 1,
+	}, dir
+}
+
+// testServers maps the sessions of test cachers to the server serving them.
+var testServers sync.Map
+
+// helper function to break the connection of the current session of the
+// test cacher.
+func dropConnection(c *cacher) {
+	server, _ := testServers.Load(c.session())
+	server.(*sftp.Server).Close()
+}
+
+// helper function to return a pipe delivering every write after the
+// latency, while later writes are not blocked by the delay.
+func delayed(latency time.Duration) (io.Reader, io.WriteCloser) {
+	r, w := io.Pipe()
+	if latency == 0 {
+		return r, w
+	}
+
+	type packet struct {
+		data []byte
+		at   time.Time
+	}
+	packets := make(chan packet, 4096)
+
+	go func() {
+		for p := range packets {
+			time.Sleep(time.Until(p.at))
+			if _, err := w.Write(p.data); err != nil {
+				break
+			}
+		}
+		w.Close()
+	}()
+
+	return r, &delayWriter{packets: func(b []byte) {
+		packets <- packet{append([]byte(nil), b...), time.Now().Add(latency)}
+	}, close: func() { close(packets) }}
+}
+
+type delayWriter struct {
+	packets func([]byte)
+	close   func()
+	once    sync.Once
+}
+
+func (w *delayWriter) Write(b []byte) (int, error) {
+	w.packets(b)
+	return len(b), nil
+}
+
+func (w *delayWriter) Close() error {
+	w.once.Do(w.close)
+	return nil
+}
+
+func TestCache(t *testing.T) {
+	cachetest.Run(t, func(t *testing.T) (cache.Cache, string) {
+		return newTestCacher(t)
+	})
+}
+
+func TestGetAccessTime(t *testing.T) {
+	c, dir := newTestCacher(t)
+	p := filepath.Join(dir, "archive")
+
+	assert.NoError(t, c.Put(p, 0, strings.NewReader("content")))
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.NoError(t, os.Chtimes(p, old, old))
+
+	rc, err := c.Get(p)
+	assert.NoError(t, err)
+	rc.Close()
+
+	// the test server reports the modification time as access time
+	fi, err := os.Stat(p)
+	assert.NoError(t, err)
+	st := fi.Sys().(*syscall.Stat_t)
+	assert.True(t, time.Unix(st.Atim.Unix()).After(old), "access time is not updated")
+	assert.Equal(t, old, fi.ModTime())
+
+	atime := time.Now().Truncate(time.Second)
+	fi = newFileInfo(&testFileInfo{stat: &sftp.FileStat{Atime: uint32(atime.Unix())}})
+	assert.Equal(t, atime, cache.AccessTime(fi))
+}
+
+type testFileInfo struct {
+	os.FileInfo
+	stat *sftp.FileStat
+}
+
+func (fi *testFileInfo) Sys() interface{} { return fi.stat }
+
+func TestReconnect(t *testing.T) {
+	c, dir := newTestCacher(t)
+	p := filepath.Join(dir, "archive")
+	assert.NoError(t, c.Put(p, 0, strings.NewReader("content")))
+
+	dropConnection(c)
+	rc, err := c.Get(p)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	rc.Close()
+	assert.Equal(t, "content", string(b))
+
+	// without retries the lost connection fails the operation
+	c.retry = RetryPolicy{}
+	dropConnection(c)
+	_, err = c.Get(p)
+	assert.Error(t, err)
+	assert.NoError(t, c.Remove(p))
+}
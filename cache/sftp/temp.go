@@ -0,0 +1,96 @@
+package sftp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/appleboy/drone-sftp-cache/cache"
+	"github.com/pkg/sftp"
+)
+
+const (
+	// tempHeartbeat is the interval at which an upload records that it is
+	// alive in the metadata of its temporary file.
+	tempHeartbeat = 15 * time.Second
+
+	// tempIdle is the time after the last heartbeat after which the upload
+	// to a temporary file is considered abandoned, and may be resumed. It
+	// exceeds the longest wait between two attempts of a live upload.
+	tempIdle = 5 * time.Minute
+)
+
+// createTemp returns a unique temporary name to upload the entry p to, and
+// the metadata of the partial upload it continues. The temporary file of an
+// abandoned upload of the entry is taken over by renaming it, so no other
+// upload resumes it as well, and the abandoned upload fails when it notices.
+// Temporary files in the directory older than cache.TempMaxAge are removed.
+func (c *cacher) createTemp(p string) (string, *cache.Metadata) {
+	tmp := cache.TempName(p)
+	dir := filepath.Dir(p)
+
+	// without a listing the upload starts from scratch
+	var files []os.FileInfo
+	err := c.do(func(s *sftp.Client) (err error) {
+		files, err = s.ReadDir(dir)
+		return err
+	})
+	if err != nil {
+		return tmp, new(cache.Metadata)
+	}
+
+	var claimed string
+	prev := new(cache.Metadata)
+	now := time.Now()
+	for _, fi := range files {
+		name := fi.Name()
+		if !cache.IsTemp(name) {
+			continue
+		}
+
+		old := filepath.Join(dir, name)
+		switch {
+		case cache.IsStaleTemp(fi, now):
+			c.session().Remove(old)
+		case claimed == "" && !cache.IsMeta(name) && strings.HasPrefix(name, cache.TempPrefix(p)):
+			m, err := c.readMeta(old)
+			if err != nil || !abandoned(m, now) {
+				continue
+			}
+			if c.session().Rename(old, tmp) == nil {
+				claimed, prev = old, m
+			}
+		}
+	}
+
+	// the taken over file has no metadata until the upload records its
+	// heartbeat, so no other upload takes it over meanwhile
+	if claimed != "" {
+		c.removeMeta(claimed)
+	}
+	return tmp, prev
+}
+
+// abandoned reports whether the upload to the temporary file with the
+// metadata m stopped recording heartbeats at the time now. Uploads without
+// heartbeats are never resumed.
+func abandoned(m *cache.Metadata, now time.Time) bool {
+	return !m.Heartbeat.IsZero() && now.Sub(m.Heartbeat) > tempIdle
+}
+
+// rename moves the file oldname to newname, replacing newname. The
+// posix-rename@openssh.com extension replaces it atomically, servers
+// without it have newname removed first.
+func (c *cacher) rename(oldname, newname string) error {
+	return c.do(func(s *sftp.Client) error {
+		if _, ok := s.HasExtension("posix-rename@openssh.com"); ok {
+			return s.PosixRename(oldname, newname)
+		}
+
+		if err := s.Remove(newname); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return s.Rename(oldname, newname)
+	})
+}
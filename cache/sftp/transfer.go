@@ -0,0 +1,503 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/appleboy/drone-sftp-cache/cache"
+	"github.com/pkg/sftp"
+)
+
+// defaultChunkSize is the chunk size used to track the progress of an
+// upload when chunked transfers are disabled.
+const defaultChunkSize = 8 << 20
+
+// uploader tracks the chunks of an upload. The checksums of the leading
+// chunks written so far are recorded in the metadata of the partial file,
+// so an interrupted upload of the same content resumes after them.
+type uploader struct {
+	c     *cacher
+	part  string
+	chunk int64
+
+	mu        sync.Mutex
+	err       error
+	sums      []string
+	done      []bool
+	committed int
+}
+
+// upload copies src to the partial file f in chunks. Up to concurrency
+// chunks are written at the same time with WriteAt, so the transfer is not
+// bound by the round trip time of a single request. Chunks of src recorded
+// in the metadata prev of an earlier attempt are read back from f and only
+// written again if f does not hold them, the partial file may have been
+// truncated or damaged since. A heartbeat is recorded meanwhile, see
+// createTemp. It returns the metadata of src with its size and checksums.
+func (c *cacher) upload(f *remoteFile, part string, src io.Reader, prev *cache.Metadata) (*cache.Metadata, error) {
+	chunk, concurrency := c.chunkSize, c.concurrency
+	if chunk <= 0 {
+		chunk, concurrency = defaultChunkSize, 1
+	}
+
+	// the chunks of an earlier attempt only line up with the same size
+	var written []string
+	if prev.Chunk == chunk {
+		written = prev.Chunks
+	}
+
+	u := &uploader{c: c, part: part, chunk: chunk}
+	u.beat()
+	stop := u.heartbeat()
+	defer stop()
+
+	sem := make(chan struct{}, concurrency)
+	full := sha256.New()
+
+	var wg sync.WaitGroup
+	var off int64
+	for i := 0; u.failed() == nil; i++ {
+		buf := make([]byte, chunk)
+		n, err := readChunk(src, buf)
+		if n == 0 && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			wg.Wait()
+			return nil, err
+		}
+		buf = buf[:n]
+		full.Write(buf)
+
+		sum := sha256.Sum256(buf)
+		recorded := u.add(hex.EncodeToString(sum[:]), written)
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, buf []byte, off int64) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if u.failed() != nil {
+				return
+			}
+			if !recorded || !holds(f, buf, off) {
+				if _, err := f.WriteAt(buf, off); err != nil {
+					u.fail(err)
+					return
+				}
+			}
+			u.complete(i)
+		}(i, buf, off)
+		off += int64(n)
+
+		// a short read is the end of the source
+		if int64(n) < chunk {
+			break
+		}
+	}
+
+	wg.Wait()
+	if err := u.failed(); err != nil {
+		return nil, err
+	}
+	return &cache.Metadata{
+		Size:     off,
+		Checksum: hex.EncodeToString(full.Sum(nil)),
+		Chunk:    chunk,
+		Chunks:   u.sums,
+	}, nil
+}
+
+// readChunk fills buf from r. Unlike io.ReadFull it only reports io.EOF at
+// the end of r, an io.ErrUnexpectedEOF of r is an error of the source.
+func readChunk(r io.Reader, buf []byte) (int, error) {
+	var n int
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// holds reports whether the file f contains buf at the offset off.
+func holds(f io.ReaderAt, buf []byte, off int64) bool {
+	b := make([]byte, len(buf))
+	n, err := f.ReadAt(b, off)
+	if err != nil && err != io.EOF {
+		return false
+	}
+	return bytes.Equal(b[:n], buf)
+}
+
+// add records the checksum of the next chunk read from the source. It
+// reports whether the chunk is already written according to the checksums
+// of an earlier attempt.
+func (u *uploader) add(sum string, written []string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	i := len(u.sums)
+	u.sums = append(u.sums, sum)
+	u.done = append(u.done, false)
+	return i < len(written) && written[i] == sum
+}
+
+// complete marks chunk i as written and records the checksums of the
+// leading written chunks, the offset an interrupted upload resumes from.
+func (u *uploader) complete(i int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.done[i] = true
+	n := u.committed
+	for n < len(u.done) && u.done[n] {
+		n++
+	}
+	if n == u.committed || u.err != nil {
+		return
+	}
+	u.committed = n
+	u.err = u.record()
+}
+
+// beat records the heartbeat of the upload.
+func (u *uploader) beat() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.err == nil {
+		u.err = u.record()
+	}
+}
+
+// heartbeat records the heartbeat of the upload every tempHeartbeat until
+// the returned function is called.
+func (u *uploader) heartbeat() func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(tempHeartbeat)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				u.beat()
+			}
+		}
+	}()
+
+	// no heartbeat overwrites the metadata written after the upload
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// record writes the metadata of the partial file with the heartbeat and
+// the checksums of the leading written chunks, u.mu must be held. It fails
+// when the partial file was taken over by another upload.
+func (u *uploader) record() error {
+	err := u.c.do(func(s *sftp.Client) error {
+		_, err := s.Stat(u.part)
+		return err
+	})
+	if os.IsNotExist(err) {
+		return fmt.Errorf("upload to %s was taken over by another upload", u.part)
+	}
+	if err != nil {
+		return err
+	}
+	return u.c.writeMeta(u.part, &cache.Metadata{Chunk: u.chunk, Chunks: u.sums[:u.committed], Heartbeat: time.Now()})
+}
+
+// fail records the first error of the upload.
+func (u *uploader) fail(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.err == nil {
+		u.err = err
+	}
+}
+
+// failed returns the first error of the upload, if any.
+func (u *uploader) failed() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.err
+}
+
+// remoteFile is a remote file read and written at given offsets. Failed
+// operations are retried according to the retry policy of the cacher, with
+// the file opened again first.
+type remoteFile struct {
+	c    *cacher
+	path string
+	flag int
+
+	mu sync.Mutex
+	s  *sftp.Client
+	f  *sftp.File
+}
+
+// openFile opens the remote file p with the flags.
+func (c *cacher) openFile(p string, flag int) (*remoteFile, error) {
+	r := &remoteFile{c: c, path: p, flag: flag}
+	err := c.do(func(s *sftp.Client) error {
+		f, err := s.OpenFile(p, flag)
+		if err != nil {
+			return err
+		}
+		r.s, r.f = s, f
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// do calls fn with the open file, retrying it according to the retry policy
+// of the cacher.
+func (r *remoteFile) do(fn func(f *sftp.File) error) error {
+	return r.c.retry.retry(func() error {
+		s, f := r.file()
+		err := r.c.watch(s, func() error { return fn(f) })
+		if err != nil && transient(err) {
+			if lost(err) {
+				r.c.reconnect(s)
+			}
+
+			// the file was renamed or removed meanwhile
+			if rerr := r.reopen(f); os.IsNotExist(rerr) {
+				return rerr
+			}
+		}
+		return err
+	})
+}
+
+// Stat returns the file info of the open remote file.
+func (r *remoteFile) Stat() (os.FileInfo, error) {
+	var fi os.FileInfo
+	err := r.do(func(f *sftp.File) (err error) {
+		fi, err = f.Stat()
+		return err
+	})
+	return fi, err
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *remoteFile) ReadAt(b []byte, off int64) (int, error) {
+	var n int
+	var eof bool
+	err := r.do(func(f *sftp.File) error {
+		m, err := f.ReadAt(b[n:], off+int64(n))
+		n += m
+		if err == io.EOF {
+			eof = true
+			return nil
+		}
+		return err
+	})
+	if err == nil && eof {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// WriteAt implements io.WriterAt.
+func (r *remoteFile) WriteAt(b []byte, off int64) (int, error) {
+	err := r.do(func(f *sftp.File) error {
+		_, err := f.WriteAt(b, off)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// file returns the session and the currently open remote file.
+func (r *remoteFile) file() (*sftp.Client, *sftp.File) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.s, r.f
+}
+
+// reopen replaces the failed remote file f, unless a concurrent operation
+// did so already. When opening fails the next attempt fails as well. The
+// file is never created again, a missing file is another one than f.
+func (r *remoteFile) reopen(f *sftp.File) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != f {
+		return nil
+	}
+
+	s := r.c.session()
+	nf, err := s.OpenFile(r.path, r.flag&^(os.O_CREATE|os.O_TRUNC|os.O_EXCL))
+	if err != nil {
+		return err
+	}
+	f.Close()
+	r.s, r.f = s, nf
+	return nil
+}
+
+// Close closes the remote file. Every write was acknowledged by the server,
+// so a connection lost meanwhile is no error.
+func (r *remoteFile) Close() error {
+	_, f := r.file()
+	if err := f.Close(); err != nil && !lost(err) {
+		return err
+	}
+	return nil
+}
+
+// verifier compares the checksum of the data read with the recorded one
+// when the end of the data is reached.
+type verifier struct {
+	io.ReadCloser
+	path string
+	sum  string
+	h    hash.Hash
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if sum := hex.EncodeToString(v.h.Sum(nil)); sum != v.sum {
+			return n, fmt.Errorf("checksum mismatch for %s: recorded %s, read %s", v.path, v.sum, sum)
+		}
+	}
+	return n, err
+}
+
+// chunkReader reads a remote file of known size in chunks, fetching up to
+// concurrency chunks ahead with ReadAt while the caller consumes them in
+// order. Chunks with recorded checksums are only passed on when they match.
+type chunkReader struct {
+	f     *remoteFile
+	sums  []string
+	queue chan chan chunk
+	sem   chan struct{}
+	done  chan struct{}
+	once  sync.Once
+	cur   []byte
+	err   error
+}
+
+// chunk is the result of reading a single chunk.
+type chunk struct {
+	data []byte
+	err  error
+}
+
+// download returns an io.ReadCloser for the size bytes of the remote file,
+// read in chunks of the given size and verified with the checksums sums of
+// the chunks, if any. Closing the reader closes the file.
+func download(f *remoteFile, size, chunkSize int64, concurrency int, sums []string) io.ReadCloser {
+	r := &chunkReader{
+		f:     f,
+		sums:  sums,
+		queue: make(chan chan chunk, concurrency),
+		sem:   make(chan struct{}, concurrency),
+		done:  make(chan struct{}),
+	}
+	go r.fetch(size, chunkSize)
+	return r
+}
+
+// fetch starts the chunk reads in order, waiting for the consumer when
+// concurrency chunks are in flight.
+func (r *chunkReader) fetch(size, chunkSize int64) {
+	defer close(r.queue)
+
+	for off := int64(0); off < size; off += chunkSize {
+		select {
+		case r.sem <- struct{}{}:
+		case <-r.done:
+			return
+		}
+
+		n := chunkSize
+		if size-off < n {
+			n = size - off
+		}
+
+		ch := make(chan chunk, 1)
+		go func(off, n int64) {
+			buf := make([]byte, n)
+			read, err := r.f.ReadAt(buf, off)
+			if err == io.EOF && int64(read) == n {
+				err = nil
+			}
+			if err == nil && int64(read) < n {
+				err = io.ErrUnexpectedEOF
+			}
+			if i := off / chunkSize; err == nil && r.sums != nil {
+				sum := sha256.Sum256(buf)
+				if s := hex.EncodeToString(sum[:]); s != r.sums[i] {
+					err = fmt.Errorf("checksum mismatch for %s chunk %d: recorded %s, read %s", r.f.path, i, r.sums[i], s)
+				}
+			}
+			ch <- chunk{buf[:read], err}
+		}(off, n)
+
+		select {
+		case r.queue <- ch:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		ch, ok := <-r.queue
+		if !ok {
+			r.err = io.EOF
+			continue
+		}
+		c := <-ch
+		<-r.sem
+
+		// no data of a failed chunk is passed on
+		r.cur, r.err = c.data, c.err
+		if c.err != nil {
+			r.cur = nil
+		}
+	}
+
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Close stops fetching chunks and closes the remote file.
+func (r *chunkReader) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+	})
+	return r.f.Close()
+}
@@ -0,0 +1,398 @@
+package sftp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/appleboy/drone-sftp-cache/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkedPutGet(t *testing.T) {
+	c, dir := newTestCacher(t)
+	c.chunkSize = 1000
+	c.concurrency = 3
+
+	for _, size := range []int{0, 999, 1000, 3000, 10007} {
+		data := make([]byte, size)
+		rand.Read(data)
+		p := filepath.Join(dir, fmt.Sprintf("archive-%d", size))
+
+		assert.NoError(t, c.Put(p, 0, bytes.NewReader(data)))
+
+		b, err := ioutil.ReadFile(p)
+		assert.NoError(t, err)
+		assert.Equal(t, data, b, "upload of %d bytes", size)
+
+		rc, err := c.Get(p)
+		assert.NoError(t, err)
+		b, err = ioutil.ReadAll(rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+		assert.Equal(t, data, b, "download of %d bytes", size)
+	}
+}
+
+func TestChunkedGetClose(t *testing.T) {
+	c, dir := newTestCacher(t)
+	c.chunkSize = 100
+	c.concurrency = 2
+
+	p := filepath.Join(dir, "archive")
+	assert.NoError(t, c.Put(p, 0, bytes.NewReader(make([]byte, 10000))))
+
+	// closing a partially read file stops the transfer
+	rc, err := c.Get(p)
+	assert.NoError(t, err)
+	_, err = rc.Read(make([]byte, 10))
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+}
+
+// BenchmarkTransfer compares single stream and chunked transfers of a large
+// file over a connection with 2ms latency in each direction.
+func BenchmarkTransfer(b *testing.B) {
+	const size = 16 << 20
+
+	data := make([]byte, size)
+	rand.Read(data)
+
+	tests := []struct {
+		name        string
+		chunkSize   int64
+		concurrency int
+	}{
+		{"stream", 0, 1},
+		{"chunked-4MB-x4", 4 << 20, 4},
+		{"chunked-2MB-x8", 2 << 20, 8},
+	}
+
+	for _, tt := range tests {
+		c, dir := newLatencyCacher(b, 2*time.Millisecond)
+		c.chunkSize = tt.chunkSize
+		c.concurrency = tt.concurrency
+		p := filepath.Join(dir, "archive")
+
+		b.Run("put/"+tt.name, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				if err := c.Put(p, 0, bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run("get/"+tt.name, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				rc, err := c.Get(p)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := ioutil.ReadAll(rc); err != nil {
+					b.Fatal(err)
+				}
+				rc.Close()
+			}
+		})
+	}
+}
+
+// failingReader returns an error once the reader r is drained.
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection lost")
+	}
+	return n, err
+}
+
+// helper function to return the temporary file of an interrupted upload of
+// the entry p, with its last heartbeat moved back to mark it as abandoned.
+func abandonedTemp(t *testing.T, p string) string {
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+".*"+cache.PartSuffix))
+	assert.NoError(t, err)
+	if len(matches) != 1 {
+		t.Fatalf("expected one temporary file, found %v", matches)
+	}
+
+	b, err := ioutil.ReadFile(matches[0] + cache.MetaSuffix)
+	assert.NoError(t, err)
+	m := new(cache.Metadata)
+	assert.NoError(t, json.Unmarshal(b, m))
+	m.Heartbeat = time.Now().Add(-2 * tempIdle)
+	b, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(matches[0]+cache.MetaSuffix, b, 0644))
+	return matches[0]
+}
+
+func TestPutResume(t *testing.T) {
+	c, dir := newTestCacher(t)
+	c.chunkSize = 1000
+	p := filepath.Join(dir, "archive")
+
+	data := make([]byte, 4500)
+	rand.Read(data)
+
+	// an interrupted upload keeps the temporary file
+	assert.Error(t, c.Put(p, 0, &failingReader{bytes.NewReader(data[:2500])}))
+	_, err := os.Stat(p)
+	assert.True(t, os.IsNotExist(err))
+
+	tmp := abandonedTemp(t, p)
+	m, err := c.readMeta(tmp)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), m.Chunk)
+	assert.Len(t, m.Chunks, 2)
+
+	// the written chunks are read back, not uploaded again
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.NoError(t, os.Chtimes(tmp, old, old))
+	f, err := c.openFile(tmp, os.O_RDWR)
+	assert.NoError(t, err)
+	_, err = c.upload(f, tmp, bytes.NewReader(data[:2000]), m)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	fi, err := os.Stat(tmp)
+	assert.NoError(t, err)
+	assert.Equal(t, old, fi.ModTime())
+
+	abandonedTemp(t, p)
+	assert.NoError(t, c.Put(p, 0, bytes.NewReader(data)))
+	b, err := ioutil.ReadFile(p)
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+
+	matches, err := filepath.Glob(filepath.Join(dir, ".archive.*"))
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+}
+
+func TestPutResumeDamaged(t *testing.T) {
+	damage := map[string]func(string) error{
+		"changed": func(tmp string) error {
+			f, err := os.OpenFile(tmp, os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = f.WriteAt([]byte("damaged"), 10)
+			return err
+		},
+		"truncated": func(tmp string) error {
+			return os.Truncate(tmp, 1500)
+		},
+	}
+
+	for name, fn := range damage {
+		c, dir := newTestCacher(t)
+		c.chunkSize = 1000
+		p := filepath.Join(dir, "archive")
+
+		data := make([]byte, 4500)
+		rand.Read(data)
+		assert.Error(t, c.Put(p, 0, &failingReader{bytes.NewReader(data[:2500])}), name)
+
+		// the recorded chunks no longer match the temporary file
+		assert.NoError(t, fn(abandonedTemp(t, p)), name)
+		abandonedTemp(t, p)
+		assert.NoError(t, c.Put(p, 0, bytes.NewReader(data)), name)
+
+		rc, err := c.Get(p)
+		assert.NoError(t, err, name)
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err, name)
+		assert.NoError(t, rc.Close(), name)
+		assert.Equal(t, data, b, name)
+	}
+}
+
+func TestRestoreCorrupted(t *testing.T) {
+	c, dir := newTestCacher(t)
+	p := filepath.Join(dir, "archive")
+
+	src, dst := t.TempDir(), t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(src, "file"), []byte("content"), 0644))
+	assert.NoError(t, cache.Rebuild(c, src, p, cache.Options{}))
+
+	// flip a byte of the content, which follows the header of the file
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte{'C'}, 512)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	// the corrupted chunk is rejected before it is extracted
+	err = cache.Restore(c, p, dst, cache.Options{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "checksum mismatch")
+	}
+	_, err = os.Stat(filepath.Join(dst, "file"))
+	assert.True(t, os.IsNotExist(err), "corrupted file restored")
+}
+
+func TestGetVerifiesChunks(t *testing.T) {
+	c, dir := newTestCacher(t)
+	c.chunkSize = 1000
+	c.concurrency = 2
+	p := filepath.Join(dir, "archive")
+
+	data := make([]byte, 3500)
+	rand.Read(data)
+	assert.NoError(t, c.Put(p, 0, bytes.NewReader(data)))
+
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte{^data[2100]}, 2100)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	// the chunks before the corrupted one are read, nothing of it
+	for _, chunkSize := range []int64{0, 1000} {
+		c.chunkSize = chunkSize
+		rc, err := c.Get(p)
+		assert.NoError(t, err)
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, rc.Close())
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "checksum mismatch")
+		}
+		assert.Equal(t, data[:2000], b)
+	}
+}
+
+func TestPutSourceError(t *testing.T) {
+	c, dir := newTestCacher(t)
+	p := filepath.Join(dir, "archive")
+	assert.NoError(t, c.Put(p, 0, bytes.NewReader([]byte("content"))))
+
+	// an unexpected EOF of the source is no end of the data
+	r, w := io.Pipe()
+	go func() {
+		w.Write([]byte("partial"))
+		w.CloseWithError(io.ErrUnexpectedEOF)
+	}()
+	assert.Equal(t, io.ErrUnexpectedEOF, c.Put(p, 0, r))
+
+	b, err := ioutil.ReadFile(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(b))
+}
+
+func TestPutResumeLive(t *testing.T) {
+	c, dir := newTestCacher(t)
+	c.chunkSize = 1000
+	p := filepath.Join(dir, "archive")
+
+	data := make([]byte, 2500)
+	rand.Read(data)
+
+	// a slow upload does not write the temporary file for a while
+	r, w := io.Pipe()
+	done := make(chan error)
+	go func() { done <- c.Put(p, 0, r) }()
+	_, err := w.Write(data[:1000])
+	assert.NoError(t, err)
+	matches, err := filepath.Glob(filepath.Join(dir, ".archive.*"+cache.PartSuffix))
+	assert.NoError(t, err)
+	assert.Len(t, matches, 1)
+	old := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(matches[0], old, old))
+
+	// its heartbeat keeps another upload from taking it over
+	assert.NoError(t, c.Put(p, 0, bytes.NewReader(data)))
+	_, err = os.Stat(matches[0])
+	assert.NoError(t, err)
+
+	_, err = w.Write(data[1000:])
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.NoError(t, <-done)
+
+	b, err := ioutil.ReadFile(p)
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+}
+
+func TestUploadTakenOver(t *testing.T) {
+	c, dir := newTestCacher(t)
+	c.chunkSize = 1000
+	tmp := filepath.Join(dir, ".archive.0123456789abcdef"+cache.PartSuffix)
+
+	f, err := c.openFile(tmp, os.O_RDWR|os.O_CREATE)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	// another upload renamed the file, the connection drops meanwhile
+	assert.NoError(t, os.Rename(tmp, tmp+".other"))
+	dropConnection(c)
+
+	_, err = f.WriteAt(make([]byte, 1000), 1000)
+	assert.Error(t, err)
+	_, err = os.Stat(tmp)
+	assert.True(t, os.IsNotExist(err), "temporary file created again")
+
+	// the upload notices on its next heartbeat
+	_, err = c.upload(f, tmp, bytes.NewReader(make([]byte, 1000)), new(cache.Metadata))
+	assert.Error(t, err)
+}
+
+func TestPutResumeChanged(t *testing.T) {
+	c, dir := newTestCacher(t)
+	c.chunkSize = 1000
+	p := filepath.Join(dir, "archive")
+
+	old := make([]byte, 5000)
+	rand.Read(old)
+	assert.Error(t, c.Put(p, 0, &failingReader{bytes.NewReader(old[:4000])}))
+	abandonedTemp(t, p)
+
+	// a temporary file of other content is overwritten and truncated
+	data := append([]byte(nil), old[:1000]...)
+	data = append(data, make([]byte, 1500)...)
+	assert.NoError(t, c.Put(p, 0, bytes.NewReader(data)))
+
+	rc, err := c.Get(p)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	assert.Equal(t, data, b)
+}
+
+func TestGetReconnect(t *testing.T) {
+	c, dir := newTestCacher(t)
+	c.chunkSize = 1000
+	p := filepath.Join(dir, "archive")
+
+	data := make([]byte, 10000)
+	rand.Read(data)
+	assert.NoError(t, c.Put(p, 0, bytes.NewReader(data)))
+
+	rc, err := c.Get(p)
+	assert.NoError(t, err)
+	b := make([]byte, 100)
+	_, err = io.ReadFull(rc, b)
+	assert.NoError(t, err)
+
+	// the download continues over a new connection
+	dropConnection(c)
+	rest, err := ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.NoError(t, rc.Close())
+	assert.Equal(t, data, append(b, rest...))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/appleboy/drone-sftp-cache/cache"
+)
+
+// branchSuffix is appended to the name of a remote cache to record the
+// branch it was built for.
+const branchSuffix = ".branch"
+
+// ProcessFlush removes the remote caches of the repository that are older
+// than the flush age or belong to branches that no longer exist.
+func (p Plugin) ProcessFlush(c cache.Cache) error {
+	root := filepath.Join(p.Path, p.Repo)
+
+	files, err := c.List(root)
+	if err != nil {
+		return err
+	}
+
+	// the branches of the remote caches, see writeBranch
+	markers := map[string]bool{}
+	for _, fi := range files {
+		if strings.HasSuffix(fi.Name(), branchSuffix) {
+			markers[strings.TrimSuffix(fi.Name(), branchSuffix)] = true
+		}
+	}
+
+	live := map[string]bool{}
+	for _, branch := range append(p.Branches, p.Default, p.Branch) {
+		if branch != "" {
+			live[branch] = true
+		}
+	}
+
+	var removed int
+	var reclaimed int64
+	now := time.Now()
+
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || isMarker(name) {
+			continue
+		}
+		delete(markers, name)
+
+		var reason string
+		if p.FlushAge > 0 && now.Sub(fi.ModTime()) > p.FlushAge {
+			reason = "last built " + fi.ModTime().Format(time.RFC3339)
+		} else if len(p.Branches) != 0 {
+			branch, err := readBranch(c, filepath.Join(root, name))
+			if err != nil {
+				return err
+			}
+			if branch != "" && !live[branch] {
+				reason = "branch <" + branch + "> no longer exists"
+			}
+		}
+		if reason == "" {
+			continue
+		}
+
+		log.Printf("flushing remote cache <%s>, %s\n", name, reason)
+		removed++
+		reclaimed += fi.Size()
+
+		if p.DryRun {
+			continue
+		}
+		if err := c.Remove(filepath.Join(root, name)); err != nil {
+			return err
+		}
+		if err := removeBranch(c, filepath.Join(root, name)); err != nil {
+			return err
+		}
+	}
+
+	// branch records left behind by removed caches
+	for name := range markers {
+		if p.DryRun {
+			continue
+		}
+		if err := removeBranch(c, filepath.Join(root, name)); err != nil {
+			return err
+		}
+	}
+
+	if p.DryRun {
+		log.Printf("dry run, flushing would remove %d remote caches and reclaim %s\n", removed, formatSize(reclaimed))
+	} else {
+		log.Printf("flushed %d remote caches, reclaimed %s\n", removed, formatSize(reclaimed))
+	}
+	return nil
+}
+
+// helper function to remove the least recently used remote caches of the
+// repository until their total size fits the quota. The caches in keep, like
+// the ones just rebuilt, are never removed.
+func (p Plugin) evict(c cache.Cache, keep map[string]bool) error {
+	root := filepath.Join(p.Path, p.Repo)
+
+	files, err := c.List(root)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	var entries []os.FileInfo
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		total += fi.Size()
+		if !keep[fi.Name()] && !isMarker(fi.Name()) {
+			entries = append(entries, fi)
+		}
+	}
+	if total <= p.Quota {
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return cache.AccessTime(entries[i]).Before(cache.AccessTime(entries[j]))
+	})
+
+	log.Printf("remote caches use %s, over the quota of %s\n", formatSize(total), formatSize(p.Quota))
+	for _, fi := range entries {
+		if total <= p.Quota {
+			break
+		}
+
+		log.Printf("evicting remote cache <%s>, last used %s\n", fi.Name(), cache.AccessTime(fi).Format(time.RFC3339))
+		if err := c.Remove(filepath.Join(root, fi.Name())); err != nil {
+			return err
+		}
+		if err := removeBranch(c, filepath.Join(root, fi.Name())); err != nil {
+			return err
+		}
+		total -= fi.Size()
+	}
+	return nil
+}
+
+// helper function to report whether the file name is the branch record or
+// the lock of a remote cache rather than a remote cache itself.
+func isMarker(name string) bool {
+	return strings.HasSuffix(name, branchSuffix) || strings.HasSuffix(name, lockSuffix)
+}
+
+// helper function to record the branch the remote cache path was built for.
+func writeBranch(c cache.Cache, path, branch string, ttl time.Duration) error {
+	return c.Put(path+branchSuffix, ttl, strings.NewReader(branch))
+}
+
+// helper function to read the branch the remote cache path was built for.
+// Caches without a branch record return an empty branch.
+func readBranch(c cache.Cache, path string) (string, error) {
+	rc, err := c.Get(path + branchSuffix)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	return string(b), err
+}
+
+// helper function to remove the branch record of the remote cache path.
+func removeBranch(c cache.Cache, path string) error {
+	err := c.Remove(path + branchSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
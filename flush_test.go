@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessFlush(t *testing.T) {
+	root := "/cache/octocat/hello-world/"
+	now := time.Now()
+
+	c := newFakeCache()
+	c.files[root+"old"] = fakeFile{data: []byte("old"), modTime: now.Add(-48 * time.Hour)}
+	c.files[root+"fresh"] = fakeFile{data: []byte("fresh"), modTime: now}
+	c.files[root+"deleted"] = fakeFile{data: []byte("deleted"), modTime: now}
+	c.files[root+"unknown"] = fakeFile{data: []byte("unknown"), modTime: now}
+	c.files[root+"orphan.branch"] = fakeFile{data: []byte("master"), modTime: now}
+	assert.NoError(t, writeBranch(c, root+"old", "master", 0))
+	assert.NoError(t, writeBranch(c, root+"fresh", "master", 0))
+	assert.NoError(t, writeBranch(c, root+"deleted", "feature", 0))
+
+	p := Plugin{
+		Path:     "/cache",
+		Repo:     "octocat/hello-world",
+		Default:  "master",
+		FlushAge: 24 * time.Hour,
+		Branches: []string{"develop"},
+		DryRun:   true,
+	}
+
+	assert.NoError(t, p.ProcessFlush(c))
+	assert.Len(t, c.files, 8)
+
+	p.DryRun = false
+	assert.NoError(t, p.ProcessFlush(c))
+
+	assert.Len(t, c.files, 3)
+	for _, name := range []string{"fresh", "fresh.branch", "unknown"} {
+		assert.Contains(t, c.files, root+name)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	root := "/cache/octocat/hello-world/"
+	now := time.Now()
+
+	c := newFakeCache()
+	c.files[root+"oldest"] = fakeFile{data: make([]byte, 400), modTime: now.Add(-3 * time.Hour)}
+	c.files[root+"older"] = fakeFile{data: make([]byte, 400), modTime: now.Add(-2 * time.Hour)}
+	c.files[root+"recent"] = fakeFile{data: make([]byte, 400), modTime: now.Add(-time.Hour)}
+	c.files[root+"rebuilt"] = fakeFile{data: make([]byte, 400), modTime: now.Add(-4 * time.Hour)}
+	assert.NoError(t, writeBranch(c, root+"oldest", "master", 0))
+
+	p := Plugin{
+		Path:  "/cache",
+		Repo:  "octocat/hello-world",
+		Quota: 1000,
+	}
+
+	assert.NoError(t, p.evict(c, map[string]bool{"rebuilt": true}))
+	assert.Len(t, c.files, 2)
+	assert.Contains(t, c.files, root+"recent")
+	assert.Contains(t, c.files, root+"rebuilt")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// keyData is the data available to the cache key templates.
+type keyData struct {
+	Repo    string
+	Branch  string
+	Default string
+	Mount   string
+}
+
+// keyFuncs are the helper functions available to the cache key templates.
+var keyFuncs = template.FuncMap{
+	"checksum": checksum,
+	"arch":     func() string { return runtime.GOARCH },
+	"os":       func() string { return runtime.GOOS },
+	"epoch":    func() string { return strconv.FormatInt(time.Now().Unix(), 10) },
+}
+
+// replaces characters which can't be part of a remote file name.
+var keyReplacer = strings.NewReplacer("/", "-", `\`, "-", " ", "-")
+
+// helper function to parse the cache key template.
+func parseKey(text string) (*template.Template, error) {
+	return template.New("cache_key").Funcs(keyFuncs).Option("missingkey=error").Parse(text)
+}
+
+// helper function to render the cache key template with the given data.
+func renderKey(text string, data keyData) (string, error) {
+	tmpl, err := parseKey(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	key := keyReplacer.Replace(strings.TrimSpace(buf.String()))
+	if key == "" {
+		return "", fmt.Errorf("cache key %q renders to an empty name", text)
+	}
+	return key, nil
+}
+
+// helper function to calculate the sha256 checksum of the file, used to tie
+// cache keys to lockfiles.
+func checksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
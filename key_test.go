@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "key")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	lock := filepath.Join(dir, "package-lock.json")
+	assert.NoError(t, ioutil.WriteFile(lock, []byte("{}"), 0644))
+
+	data := keyData{Repo: "octocat/hello-world", Branch: "feature/cache"}
+
+	key, err := renderKey(`{{ .Repo }}-{{ .Branch }}-{{ arch }}`, data)
+	assert.NoError(t, err)
+	assert.Equal(t, "octocat-hello-world-feature-cache-"+runtime.GOARCH, key)
+
+	key, err = renderKey(`deps-{{ checksum "`+lock+`" }}`, data)
+	assert.NoError(t, err)
+	assert.Equal(t, "deps-44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", key)
+
+	_, err = renderKey(`{{ checksum "missing.json" }}`, data)
+	assert.Error(t, err)
+
+	_, err = renderKey(`{{ .Unknown }}`, data)
+	assert.Error(t, err)
+
+	_, err = renderKey(` `, data)
+	assert.Error(t, err)
+}
+
+func TestPluginKey(t *testing.T) {
+	p := Plugin{Repo: "octocat/hello-world"}
+
+	key, err := p.key("node_modules", "master")
+	assert.NoError(t, err)
+	assert.Equal(t, hasher(archiveFormat, "node_modules", "master"), key)
+
+	p.IgnoreBranch = true
+	key, err = p.key("node_modules", "master")
+	assert.NoError(t, err)
+	assert.Equal(t, hasher(archiveFormat, "node_modules"), key)
+
+	p.CacheKey = "{{ .Branch }}-{{ os }}"
+	key, err = p.key("node_modules", "master")
+	assert.NoError(t, err)
+	assert.Equal(t, "master-"+runtime.GOOS+"-"+hasher(archiveFormat, "node_modules"), key)
+}
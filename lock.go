@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/appleboy/drone-sftp-cache/cache"
+)
+
+// lockSuffix is appended to the name of a remote cache to lock it while it
+// is rebuilt.
+const lockSuffix = ".lock"
+
+// takeoverTimeout is the time after which the takeover of a stale lock by a
+// build which did not finish it is abandoned.
+const takeoverTimeout = time.Minute
+
+// lockInfo is stored in the lock file of a remote cache.
+type lockInfo struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+
+	// token identifies the content of the lock file it was read from.
+	token string
+}
+
+// lockedError is returned when the remote cache is locked by another build.
+type lockedError struct {
+	path string
+	info lockInfo
+}
+
+func (e *lockedError) Error() string {
+	return fmt.Sprintf("remote cache <%s> is locked by %s until %s", e.path, e.info.Owner, e.info.Expires.Format(time.RFC3339))
+}
+
+// lock is held on a remote cache while it is rebuilt.
+type lock struct {
+	c     cache.Cache
+	path  string
+	owner string
+}
+
+// helper function to return a name identifying this build as lock owner.
+func lockOwner() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s[%d]-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// helper function to lock the remote cache path for the owner, the lock
+// expires after the timeout. The first build to create the lock file wins,
+// a lock held by another build is reported as *lockedError unless it expired,
+// then it is taken over, see removeStale. Caches without exclusive creates
+// are not locked and return a nil lock.
+func acquireLock(c cache.Cache, path, owner string, timeout time.Duration) (*lock, error) {
+	ex, ok := c.(cache.Exclusive)
+	if !ok {
+		return nil, nil
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		b, err := json.Marshal(lockInfo{Owner: owner, Expires: time.Now().Add(timeout)})
+		if err != nil {
+			return nil, err
+		}
+
+		err = ex.Create(path+lockSuffix, 0, bytes.NewReader(b))
+		if err == nil {
+			return &lock{c: c, path: path, owner: owner}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		held, err := readLock(c, path)
+		if os.IsNotExist(err) {
+			// released meanwhile, try again
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if time.Now().Before(held.Expires) || attempt > 0 {
+			return nil, &lockedError{path, *held}
+		}
+
+		log.Printf("taking over the stale lock of remote cache <%s> held by %s\n", path, held.Owner)
+		if err := removeStale(c, ex, path, owner, held); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("could not lock remote cache <%s>", path)
+}
+
+// helper function to remove the stale lock held of the remote cache path.
+// Builds finding the same stale lock race to create a takeover file named
+// after its content, only the winner removes the lock and only if it did
+// not change meanwhile. Otherwise a build reading the stale lock late could
+// remove the lock another build just took over with. The exclusive create
+// of the lock decides between the winner and builds starting afterwards.
+func removeStale(c cache.Cache, ex cache.Exclusive, path, owner string, held *lockInfo) error {
+	takeover := path + "." + held.token + lockSuffix
+
+	b, err := json.Marshal(lockInfo{Owner: owner, Expires: time.Now().Add(takeoverTimeout)})
+	if err != nil {
+		return err
+	}
+
+	err = ex.Create(takeover, 0, bytes.NewReader(b))
+	if os.IsExist(err) {
+		// another build is taking over, unless it gave up on the way
+		if other, err := readLock(c, path+"."+held.token); err == nil && time.Now().After(other.Expires) {
+			c.Remove(takeover)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer c.Remove(takeover)
+
+	current, err := readLock(c, path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current.token != held.token {
+		return nil
+	}
+
+	err = c.Remove(path + lockSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// helper function to read the lock of the remote cache path. Unreadable
+// lock files are reported as expired.
+func readLock(c cache.Cache, path string) (*lockInfo, error) {
+	rc, err := c.Get(path + lockSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	token := hex.EncodeToString(sum[:8])
+
+	info := new(lockInfo)
+	if err := json.Unmarshal(b, info); err != nil {
+		return &lockInfo{Owner: "an unknown build", token: token}, nil
+	}
+	info.token = token
+	return info, nil
+}
+
+// release removes the lock unless another build took it over. Releasing a
+// nil lock does nothing.
+func (l *lock) release() error {
+	if l == nil {
+		return nil
+	}
+
+	held, err := readLock(l.c, l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if held.Owner != l.owner {
+		log.Printf("lock of remote cache <%s> was taken over by %s\n", l.path, held.Owner)
+		return nil
+	}
+
+	err = l.c.Remove(l.path + lockSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/appleboy/drone-sftp-cache/cache/local"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcquireLock(t *testing.T) {
+	c := newFakeCache()
+	path := "/cache/octocat/hello-world/archive"
+
+	// the first build wins
+	first, err := acquireLock(c, path, "first", time.Hour)
+	assert.NoError(t, err)
+	assert.NotNil(t, first)
+
+	_, err = acquireLock(c, path, "second", time.Hour)
+	assert.IsType(t, &lockedError{}, err)
+	assert.Contains(t, err.Error(), "first")
+
+	// a stale lock is taken over
+	b, err := json.Marshal(lockInfo{Owner: "first", Expires: time.Now().Add(-time.Minute)})
+	assert.NoError(t, err)
+	c.files[path+lockSuffix] = fakeFile{data: b, modTime: time.Now()}
+
+	second, err := acquireLock(c, path, "second", time.Hour)
+	assert.NoError(t, err)
+
+	// the first build must not release the lock taken over
+	assert.NoError(t, first.release())
+	assert.Contains(t, c.files, path+lockSuffix)
+
+	assert.NoError(t, second.release())
+	assert.NotContains(t, c.files, path+lockSuffix)
+
+	// unreadable locks are stale
+	c.files[path+lockSuffix] = fakeFile{data: []byte("{"), modTime: time.Now()}
+	third, err := acquireLock(c, path, "third", time.Hour)
+	assert.NoError(t, err)
+	assert.NoError(t, third.release())
+}
+
+// hookCache calls the hook once, after the first file is read.
+type hookCache struct {
+	*fakeCache
+	hook func()
+}
+
+func (c *hookCache) Get(p string) (io.ReadCloser, error) {
+	rc, err := c.fakeCache.Get(p)
+	if hook := c.hook; hook != nil {
+		c.hook = nil
+		hook()
+	}
+	return rc, err
+}
+
+func TestAcquireLockLateTakeover(t *testing.T) {
+	c := &hookCache{fakeCache: newFakeCache()}
+	path := "/cache/octocat/hello-world/archive"
+
+	b, err := json.Marshal(lockInfo{Owner: "crashed", Expires: time.Now().Add(-time.Minute)})
+	assert.NoError(t, err)
+	c.files[path+lockSuffix] = fakeFile{data: b, modTime: time.Now()}
+
+	// the first build takes the stale lock over after the second one read it
+	var first *lock
+	c.hook = func() {
+		first, err = acquireLock(c, path, "first", time.Hour)
+		assert.NoError(t, err)
+	}
+	_, err = acquireLock(c, path, "second", time.Hour)
+	assert.IsType(t, &lockedError{}, err)
+	assert.NotNil(t, first)
+
+	held, err := readLock(c, path)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", held.Owner)
+
+	// no takeover files are left behind
+	assert.Len(t, c.files, 1)
+}
+
+func TestAcquireLockConcurrentTakeover(t *testing.T) {
+	dir := t.TempDir()
+	c, err := local.New(dir)
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "archive")
+
+	b, err := json.Marshal(lockInfo{Owner: "crashed", Expires: time.Now().Add(-time.Minute)})
+	assert.NoError(t, err)
+	assert.NoError(t, c.Put(path+lockSuffix, 0, bytes.NewReader(b)))
+
+	var wg sync.WaitGroup
+	var acquired int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := acquireLock(c, path, fmt.Sprintf("build %d", i), time.Hour)
+			if err == nil {
+				atomic.AddInt32(&acquired, 1)
+				return
+			}
+			assert.IsType(t, &lockedError{}, err)
+		}(i)
+	}
+	wg.Wait()
+
+	// exactly one build took the stale lock over
+	assert.Equal(t, int32(1), acquired)
+}
+
+func TestProcessRebuildLocked(t *testing.T) {
+	mount, err := ioutil.TempDir("", "mount")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mount)
+	assert.NoError(t, ioutil.WriteFile(mount+"/file", []byte("content"), 0644))
+
+	p := Plugin{
+		Path:         "/cache",
+		Repo:         "octocat/hello-world",
+		Branch:       "master",
+		Mount:        []string{mount},
+		IgnoreBranch: true,
+		Lock:         true,
+		LockTimeout:  time.Hour,
+	}
+	path := "/cache/octocat/hello-world/" + hasher(archiveFormat, mount)
+
+	c := newFakeCache()
+	l, err := acquireLock(c, path, "other", time.Hour)
+	assert.NoError(t, err)
+
+	// another build holds the lock
+	assert.NoError(t, p.ProcessRebuild(c))
+	assert.NotContains(t, c.files, path)
+
+	assert.NoError(t, l.release())
+	assert.NoError(t, p.ProcessRebuild(c))
+	assert.Contains(t, c.files, path)
+	assert.NotContains(t, c.files, path+lockSuffix)
+}
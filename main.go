@@ -1,8 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	_ "github.com/joho/godotenv/autoload"
@@ -50,6 +55,113 @@ func main() {
 			Usage:  "restore the cache directories",
 			EnvVar: "PLUGIN_RESTORE",
 		},
+		cli.BoolFlag{
+			Name:   "flush",
+			Usage:  "remove old remote caches",
+			EnvVar: "PLUGIN_FLUSH",
+		},
+		cli.DurationFlag{
+			Name:   "flush_age",
+			Usage:  "remove remote caches not rebuilt for this long, e.g. 720h",
+			EnvVar: "PLUGIN_FLUSH_AGE",
+		},
+		cli.StringSliceFlag{
+			Name:   "branches",
+			Usage:  "existing branches, remote caches of other branches are flushed",
+			EnvVar: "PLUGIN_BRANCHES",
+		},
+		cli.BoolFlag{
+			Name:   "dry_run",
+			Usage:  "only report the remote caches a flush would remove",
+			EnvVar: "PLUGIN_DRY_RUN",
+		},
+		cli.StringFlag{
+			Name:   "quota",
+			Usage:  "maximum size of the remote caches of the repository, e.g. 20GB",
+			EnvVar: "PLUGIN_QUOTA",
+		},
+		cli.IntFlag{
+			Name:   "parallelism",
+			Usage:  "number of directories processed at the same time",
+			EnvVar: "PLUGIN_PARALLELISM",
+			Value:  1,
+		},
+		cli.StringFlag{
+			Name:   "chunk_size",
+			Usage:  "split larger archives into chunks transferred in parallel, 0 disables it",
+			EnvVar: "PLUGIN_CHUNK_SIZE",
+			Value:  "16MB",
+		},
+		cli.IntFlag{
+			Name:   "chunk_concurrency",
+			Usage:  "number of chunks transferred at the same time",
+			EnvVar: "PLUGIN_CHUNK_CONCURRENCY",
+			Value:  4,
+		},
+		cli.BoolFlag{
+			Name:   "lock",
+			Usage:  "lock remote caches while they are rebuilt, other builds skip them",
+			EnvVar: "PLUGIN_LOCK",
+		},
+		cli.DurationFlag{
+			Name:   "lock_timeout",
+			Usage:  "time after which a lock is considered stale and taken over",
+			EnvVar: "PLUGIN_LOCK_TIMEOUT",
+			Value:  time.Hour,
+		},
+		cli.IntFlag{
+			Name:   "retry_attempts",
+			Usage:  "number of attempts of connecting and cache operations failing with transient errors",
+			EnvVar: "PLUGIN_RETRY_ATTEMPTS",
+			Value:  3,
+		},
+		cli.DurationFlag{
+			Name:   "retry_delay",
+			Usage:  "wait before the first retry, doubled for every further retry",
+			EnvVar: "PLUGIN_RETRY_DELAY",
+			Value:  time.Second,
+		},
+		cli.Float64Flag{
+			Name:   "retry_jitter",
+			Usage:  "fraction of the retry delay randomized",
+			EnvVar: "PLUGIN_RETRY_JITTER",
+			Value:  0.2,
+		},
+		cli.DurationFlag{
+			Name:   "dial_timeout",
+			Usage:  "timeout of connecting to the sftp server, defaults to 5m",
+			EnvVar: "PLUGIN_DIAL_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "idle_timeout",
+			Usage:  "time after which an operation receiving no data fails and the connection is established again",
+			EnvVar: "PLUGIN_IDLE_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "keepalive",
+			Usage:  "interval of keepalive requests sent to the sftp server",
+			EnvVar: "PLUGIN_KEEPALIVE",
+		},
+		cli.StringSliceFlag{
+			Name:   "ciphers",
+			Usage:  "allowed ssh ciphers in order of preference",
+			EnvVar: "PLUGIN_CIPHERS",
+		},
+		cli.StringSliceFlag{
+			Name:   "key_exchanges",
+			Usage:  "allowed ssh key exchange algorithms in order of preference",
+			EnvVar: "PLUGIN_KEY_EXCHANGES",
+		},
+		cli.StringSliceFlag{
+			Name:   "macs",
+			Usage:  "allowed ssh MAC algorithms in order of preference",
+			EnvVar: "PLUGIN_MACS",
+		},
+		cli.StringSliceFlag{
+			Name:   "host_key_algorithms",
+			Usage:  "allowed ssh host key algorithms in order of preference",
+			EnvVar: "PLUGIN_HOST_KEY_ALGORITHMS",
+		},
 		cli.BoolFlag{
 			Name:   "ignore_branch",
 			Usage:  "ignore branch name on hash value",
@@ -66,9 +178,15 @@ func main() {
 			EnvVar: "SFTP_CACHE_PORT,PLUGIN_PORT",
 			Value:  "22",
 		},
+		cli.StringFlag{
+			Name:   "backend",
+			Usage:  "cache backend, sftp or local",
+			EnvVar: "SFTP_CACHE_BACKEND,PLUGIN_BACKEND",
+			Value:  "sftp",
+		},
 		cli.StringFlag{
 			Name:   "path",
-			Usage:  "sftp server path",
+			Usage:  "cache path on the sftp server or the local directory",
 			EnvVar: "SFTP_CACHE_PATH,PLUGIN_PATH",
 			Value:  "/var/lib/cache/drone",
 		},
@@ -88,6 +206,144 @@ func main() {
 			Usage:  "sftp private key",
 			EnvVar: "SFTP_CACHE_PRIVATE_KEY,PLUGIN_KEY",
 		},
+		cli.StringFlag{
+			Name:   "key_path",
+			Usage:  "path of the sftp private key file",
+			EnvVar: "SFTP_CACHE_KEY_PATH,PLUGIN_KEY_PATH",
+		},
+		cli.StringFlag{
+			Name:   "key_passphrase",
+			Usage:  "passphrase of the sftp private key",
+			EnvVar: "SFTP_CACHE_KEY_PASSPHRASE,PLUGIN_KEY_PASSPHRASE",
+		},
+		cli.StringFlag{
+			Name:   "certificate",
+			Usage:  "openssh user certificate of the sftp private key",
+			EnvVar: "SFTP_CACHE_CERTIFICATE,PLUGIN_CERTIFICATE",
+		},
+		cli.StringFlag{
+			Name:   "certificate_path",
+			Usage:  "path of the openssh user certificate of the sftp private key",
+			EnvVar: "SFTP_CACHE_CERTIFICATE_PATH,PLUGIN_CERTIFICATE_PATH",
+		},
+		cli.StringFlag{
+			Name:   "prompts",
+			Usage:  "answers to keyboard-interactive prompts of the sftp server, as a json object",
+			EnvVar: "SFTP_CACHE_PROMPTS,PLUGIN_PROMPTS",
+		},
+		cli.StringFlag{
+			Name:   "agent_socket",
+			Usage:  "socket of the ssh agent holding the sftp keys",
+			EnvVar: "PLUGIN_AGENT_SOCKET,SSH_AUTH_SOCK",
+		},
+		cli.StringFlag{
+			Name:   "known_hosts",
+			Usage:  "known_hosts entries of the sftp server",
+			EnvVar: "SFTP_CACHE_KNOWN_HOSTS,PLUGIN_KNOWN_HOSTS",
+		},
+		cli.StringFlag{
+			Name:   "known_hosts_file",
+			Usage:  "path of a known_hosts file listing the sftp server",
+			EnvVar: "SFTP_CACHE_KNOWN_HOSTS_FILE,PLUGIN_KNOWN_HOSTS_FILE",
+		},
+		cli.StringSliceFlag{
+			Name:   "fingerprints",
+			Usage:  "SHA256 fingerprints of the sftp server host keys",
+			EnvVar: "SFTP_CACHE_FINGERPRINTS,PLUGIN_FINGERPRINTS",
+		},
+		cli.StringSliceFlag{
+			Name:   "host_ca",
+			Usage:  "public keys of the ssh certificate authorities signing the sftp server host certificates",
+			EnvVar: "SFTP_CACHE_HOST_CA,PLUGIN_HOST_CA",
+		},
+		cli.BoolFlag{
+			Name:   "insecure_ignore_host_key",
+			Usage:  "accept any sftp server host key, vulnerable to man-in-the-middle attacks",
+			EnvVar: "PLUGIN_INSECURE_IGNORE_HOST_KEY",
+		},
+		cli.StringFlag{
+			Name:   "proxy_host",
+			Usage:  "jump hosts to reach the sftp server through, [user@]host[:port] separated by commas",
+			EnvVar: "SFTP_CACHE_PROXY_HOST,PLUGIN_PROXY_HOST",
+		},
+		cli.StringFlag{
+			Name:   "proxy_port",
+			Usage:  "ssh port of the jump hosts",
+			EnvVar: "SFTP_CACHE_PROXY_PORT,PLUGIN_PROXY_PORT",
+			Value:  "22",
+		},
+		cli.StringFlag{
+			Name:   "proxy_username",
+			Usage:  "account of the jump hosts user",
+			EnvVar: "SFTP_CACHE_PROXY_USERNAME,PLUGIN_PROXY_USERNAME",
+		},
+		cli.StringFlag{
+			Name:   "proxy_password",
+			Usage:  "password of the jump hosts user",
+			EnvVar: "SFTP_CACHE_PROXY_PASSWORD,PLUGIN_PROXY_PASSWORD",
+		},
+		cli.StringFlag{
+			Name:   "proxy_key",
+			Usage:  "private key of the jump hosts user",
+			EnvVar: "SFTP_CACHE_PROXY_KEY,PLUGIN_PROXY_KEY",
+		},
+		cli.StringFlag{
+			Name:   "proxy_key_path",
+			Usage:  "path of the private key file of the jump hosts user",
+			EnvVar: "SFTP_CACHE_PROXY_KEY_PATH,PLUGIN_PROXY_KEY_PATH",
+		},
+		cli.StringFlag{
+			Name:   "proxy_key_passphrase",
+			Usage:  "passphrase of the private key of the jump hosts user",
+			EnvVar: "SFTP_CACHE_PROXY_KEY_PASSPHRASE,PLUGIN_PROXY_KEY_PASSPHRASE",
+		},
+		cli.StringFlag{
+			Name:   "proxy",
+			Usage:  "socks5 or http proxy url to connect to the sftp server through, defaults to ALL_PROXY or HTTPS_PROXY",
+			EnvVar: "SFTP_CACHE_PROXY,PLUGIN_PROXY",
+		},
+		cli.StringFlag{
+			Name:   "compression",
+			Usage:  "archive compression (none, gzip or zstd)",
+			EnvVar: "PLUGIN_COMPRESSION",
+			Value:  "none",
+		},
+		cli.IntFlag{
+			Name:   "compression_level",
+			Usage:  "archive compression level, 0 uses the default level",
+			EnvVar: "PLUGIN_COMPRESSION_LEVEL",
+		},
+		cli.StringFlag{
+			Name:   "engine",
+			Usage:  "archive engine (go or tar)",
+			EnvVar: "PLUGIN_ENGINE",
+			Value:  "go",
+		},
+		cli.StringFlag{
+			Name:   "max_size",
+			Usage:  "maximum size of a restored archive, e.g. 10GB",
+			EnvVar: "PLUGIN_MAX_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "max_files",
+			Usage:  "maximum number of files in a restored archive",
+			EnvVar: "PLUGIN_MAX_FILES",
+		},
+		cli.StringFlag{
+			Name:   "cache_key",
+			Usage:  "cache key template, e.g. {{ .Branch }}-{{ checksum \"package-lock.json\" }}",
+			EnvVar: "PLUGIN_CACHE_KEY",
+		},
+		cli.StringSliceFlag{
+			Name:   "restore_keys",
+			Usage:  "cache key prefixes to restore from when the cache key misses",
+			EnvVar: "PLUGIN_RESTORE_KEYS",
+		},
+		cli.DurationFlag{
+			Name:   "ttl",
+			Usage:  "time after which the rebuilt cache expires, e.g. 168h",
+			EnvVar: "PLUGIN_TTL",
+		},
 		cli.StringFlag{
 			Name:  "env-file",
 			Usage: "source env file",
@@ -109,10 +365,31 @@ func run(c *cli.Context) error {
 		_ = godotenv.Load(c.String("env-file"))
 	}
 
+	maxSize, err := parseSize(c.String("max_size"))
+	if err != nil {
+		return err
+	}
+
+	quota, err := parseSize(c.String("quota"))
+	if err != nil {
+		return err
+	}
+
+	chunkSize, err := parseSize(c.String("chunk_size"))
+	if err != nil {
+		return err
+	}
+
+	prompts, err := parsePrompts(c.String("prompts"))
+	if err != nil {
+		return err
+	}
+
 	plugin := Plugin{
 		IgnoreBranch: c.Bool("ignore_branch"),
 		Rebuild:      c.Bool("rebuild"),
 		Restore:      c.Bool("restore"),
+		Backend:      c.String("backend"),
 		Server:       c.String("server"),
 		Port:         c.String("port"),
 		Username:     c.String("username"),
@@ -124,7 +401,124 @@ func run(c *cli.Context) error {
 		Default:      c.String("repo.branch"),
 		Branch:       c.String("commit.branch"),
 		Message:      c.String("commit.message"),
+
+		Compression:      c.String("compression"),
+		CompressionLevel: c.Int("compression_level"),
+		Engine:           c.String("engine"),
+		MaxSize:          maxSize,
+		MaxFiles:         c.Int("max_files"),
+		CacheKey:         c.String("cache_key"),
+		RestoreKeys:      c.StringSlice("restore_keys"),
+		TTL:              c.Duration("ttl"),
+		Flush:            c.Bool("flush"),
+		FlushAge:         c.Duration("flush_age"),
+		Branches:         c.StringSlice("branches"),
+		DryRun:           c.Bool("dry_run"),
+		Quota:            quota,
+		Parallelism:      c.Int("parallelism"),
+		ChunkSize:        chunkSize,
+		ChunkConcurrency: c.Int("chunk_concurrency"),
+		Lock:             c.Bool("lock"),
+		LockTimeout:      c.Duration("lock_timeout"),
+		RetryAttempts:    c.Int("retry_attempts"),
+		RetryDelay:       c.Duration("retry_delay"),
+		RetryJitter:      c.Float64("retry_jitter"),
+		DialTimeout:      c.Duration("dial_timeout"),
+		IdleTimeout:      c.Duration("idle_timeout"),
+		KeepAlive:        c.Duration("keepalive"),
+
+		Ciphers:           c.StringSlice("ciphers"),
+		KeyExchanges:      c.StringSlice("key_exchanges"),
+		MACs:              c.StringSlice("macs"),
+		HostKeyAlgorithms: c.StringSlice("host_key_algorithms"),
+
+		KeyPath:               c.String("key_path"),
+		KeyPassphrase:         c.String("key_passphrase"),
+		Certificate:           c.String("certificate"),
+		CertificatePath:       c.String("certificate_path"),
+		Prompts:               prompts,
+		AgentSocket:           c.String("agent_socket"),
+		KnownHosts:            c.String("known_hosts"),
+		KnownHostsFile:        c.String("known_hosts_file"),
+		Fingerprints:          c.StringSlice("fingerprints"),
+		HostCAs:               c.StringSlice("host_ca"),
+		InsecureIgnoreHostKey: c.Bool("insecure_ignore_host_key"),
+
+		ProxyHost:          c.String("proxy_host"),
+		ProxyPort:          c.String("proxy_port"),
+		ProxyUsername:      c.String("proxy_username"),
+		ProxyPassword:      c.String("proxy_password"),
+		ProxyKey:           c.String("proxy_key"),
+		ProxyKeyPath:       c.String("proxy_key_path"),
+		ProxyKeyPassphrase: c.String("proxy_key_passphrase"),
+		Proxy:              c.String("proxy"),
 	}
 
 	return plugin.Exec()
 }
+
+// helper function to parse the keyboard-interactive prompts and their
+// answers, given as a JSON object like drone passes map settings. An empty
+// string is no prompts.
+func parsePrompts(s string) (map[string]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	var prompts map[string]string
+	if err := json.Unmarshal([]byte(s), &prompts); err != nil {
+		return nil, fmt.Errorf("invalid prompts, expected a map of prompts to answers: %v", err)
+	}
+	return prompts, nil
+}
+
+// helper function to parse a human readable size like 512MB or 10GB into
+// bytes. Units are powers of 1024, an empty size is zero.
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"TB", 1 << 40},
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+
+	v := strings.ToUpper(strings.TrimSpace(s))
+	if v == "" {
+		return 0, nil
+	}
+
+	size := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			v = strings.TrimSpace(strings.TrimSuffix(v, u.suffix))
+			size = u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(size)), nil
+}
+
+// helper function to format a size in bytes in human readable form.
+func formatSize(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+
+	size := float64(n)
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.1f%s", size, units[i])
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"100", 100, false},
+		{"1KB", 1024, false},
+		{"512mb", 512 << 20, false},
+		{"1.5 GB", 3 << 29, false},
+		{"2TB", 2 << 40, false},
+		{"GB", 0, true},
+		{"-1GB", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.size)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSize(%q) error = %v, wantErr %v", tt.size, err, tt.wantErr)
+			continue
+		}
+		assert.Equal(t, tt.want, got, tt.size)
+	}
+}
+
+func TestParsePrompts(t *testing.T) {
+	prompts, err := parsePrompts("")
+	assert.NoError(t, err)
+	assert.Nil(t, prompts)
+
+	prompts, err = parsePrompts(`{"Verification code": "123456"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"Verification code": "123456"}, prompts)
+
+	_, err = parsePrompts("Verification code=123456")
+	assert.Error(t, err)
+}
@@ -6,21 +6,27 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/appleboy/drone-sftp-cache/cache"
+	"github.com/appleboy/drone-sftp-cache/cache/local"
 	"github.com/appleboy/drone-sftp-cache/cache/sftp"
 )
 
 var skipRe = regexp.MustCompile(`\[(?i:cache *skip|skip *cache)\]`)
 
-// Plugin for caching directories to an SFTP server.
+// Plugin for caching directories to an SFTP server or a local directory.
 type Plugin struct {
 	IgnoreBranch bool
 	Rebuild      bool
 	Restore      bool
+	Backend      string
 	Server       string
 	Port         string
 	Username     string
@@ -32,60 +38,285 @@ type Plugin struct {
 	Branch       string
 	Default      string
 	Message      string
+
+	Compression      string
+	CompressionLevel int
+	Engine           string
+	MaxSize          int64
+	MaxFiles         int
+	CacheKey         string
+	RestoreKeys      []string
+	TTL              time.Duration
+	Flush            bool
+	FlushAge         time.Duration
+	Branches         []string
+	DryRun           bool
+	Quota            int64
+	Parallelism      int
+	ChunkSize        int64
+	ChunkConcurrency int
+	Lock             bool
+	LockTimeout      time.Duration
+	RetryAttempts    int
+	RetryDelay       time.Duration
+	RetryJitter      float64
+	DialTimeout      time.Duration
+	IdleTimeout      time.Duration
+	KeepAlive        time.Duration
+
+	Ciphers           []string
+	KeyExchanges      []string
+	MACs              []string
+	HostKeyAlgorithms []string
+
+	KeyPath               string
+	KeyPassphrase         string
+	Certificate           string
+	CertificatePath       string
+	Prompts               map[string]string
+	AgentSocket           string
+	KnownHosts            string
+	KnownHostsFile        string
+	Fingerprints          []string
+	HostCAs               []string
+	InsecureIgnoreHostKey bool
+
+	ProxyHost          string
+	ProxyPort          string
+	ProxyUsername      string
+	ProxyPassword      string
+	ProxyKey           string
+	ProxyKeyPath       string
+	ProxyKeyPassphrase string
+	Proxy              string
 }
 
 func (p *Plugin) check() error {
+	switch p.Backend {
+	case "", "sftp":
+		if err := p.checkSFTP(); err != nil {
+			return err
+		}
+	case "local":
+		if len(p.Path) == 0 {
+			return errors.New("missing path of the local cache directory")
+		}
+	default:
+		return fmt.Errorf("unsupported backend %q, expected sftp or local", p.Backend)
+	}
+
+	compression, err := cache.ParseCompression(p.Compression)
+	if err != nil {
+		return err
+	}
+
+	if err := cache.CheckLevel(compression, p.CompressionLevel); err != nil {
+		return err
+	}
+
+	if _, err := cache.ParseEngine(p.Engine); err != nil {
+		return err
+	}
+
+	// remote caches without a cache key are named by hashes, no prefix
+	// matches them
+	if len(p.RestoreKeys) > 0 && len(p.CacheKey) == 0 {
+		return errors.New("restore_keys require a cache_key")
+	}
+
+	for _, key := range append([]string{p.CacheKey}, p.RestoreKeys...) {
+		if _, err := parseKey(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkSFTP validates the settings of the sftp backend.
+func (p *Plugin) checkSFTP() error {
 	if len(p.Server) == 0 || len(p.Username) == 0 {
 		return errors.New("missing sftp server and username config")
 	}
 
-	if len(p.Password) == 0 && len(p.Key) == 0 {
-		return errors.New("missing sftp password or private key")
+	if len(p.Password) == 0 && len(p.Key) == 0 && len(p.KeyPath) == 0 && len(p.AgentSocket) == 0 && len(p.Prompts) == 0 {
+		return errors.New("missing sftp password, private key, key path, agent socket or prompts")
+	}
+
+	if len(p.KnownHosts) == 0 && len(p.KnownHostsFile) == 0 && len(p.Fingerprints) == 0 && len(p.HostCAs) == 0 && !p.InsecureIgnoreHostKey {
+		return errors.New("missing sftp host key verification, set known_hosts, known_hosts_file, fingerprints or host_ca, or insecure_ignore_host_key")
 	}
 
 	return nil
 }
 
+// config returns the settings of the sftp connection.
+func (p *Plugin) config() (sftp.Config, error) {
+	cfg := sftp.Config{
+		Server:   p.Server,
+		Port:     p.Port,
+		Username: p.Username,
+		Password: p.Password,
+		Key:      p.Key,
+		Sessions: p.Parallelism,
+
+		KeyPath:               p.KeyPath,
+		KeyPassphrase:         p.KeyPassphrase,
+		Certificate:           p.Certificate,
+		CertificatePath:       p.CertificatePath,
+		Prompts:               p.Prompts,
+		AgentSocket:           p.AgentSocket,
+		KnownHosts:            p.KnownHosts,
+		KnownHostsFile:        p.KnownHostsFile,
+		Fingerprints:          p.Fingerprints,
+		HostCAs:               p.HostCAs,
+		InsecureIgnoreHostKey: p.InsecureIgnoreHostKey,
+		Proxy:                 p.Proxy,
+
+		ChunkSize:   p.ChunkSize,
+		Concurrency: p.ChunkConcurrency,
+
+		Retry: sftp.RetryPolicy{
+			Attempts: p.RetryAttempts,
+			Delay:    p.RetryDelay,
+			Jitter:   p.RetryJitter,
+		},
+
+		DialTimeout: p.DialTimeout,
+		IdleTimeout: p.IdleTimeout,
+		KeepAlive:   p.KeepAlive,
+
+		Ciphers:           p.Ciphers,
+		KeyExchanges:      p.KeyExchanges,
+		MACs:              p.MACs,
+		HostKeyAlgorithms: p.HostKeyAlgorithms,
+	}
+
+	jumps, err := p.jumps(cfg)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Jumps = jumps
+	return cfg, nil
+}
+
+// jumps returns the jump hosts of the proxy_host setting, a comma separated
+// list of [user@]host[:port] the connection is tunneled through in order,
+// like the ProxyJump option of ssh. They log in with the proxy credentials,
+// or the ones of the server if none are set, and their host keys are
+// verified like the one of the server.
+func (p *Plugin) jumps(server sftp.Config) ([]sftp.Config, error) {
+	var jumps []sftp.Config
+	for _, spec := range strings.Split(p.ProxyHost, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+
+		jump := server
+		jump.Port = p.ProxyPort
+		if p.ProxyUsername != "" {
+			jump.Username = p.ProxyUsername
+		}
+		if p.ProxyPassword != "" || p.ProxyKey != "" || p.ProxyKeyPath != "" {
+			jump.Password = p.ProxyPassword
+			jump.Key = p.ProxyKey
+			jump.KeyPath = p.ProxyKeyPath
+			jump.KeyPassphrase = p.ProxyKeyPassphrase
+			jump.Certificate = ""
+			jump.CertificatePath = ""
+			jump.Prompts = nil
+		}
+
+		host := spec
+		if i := strings.LastIndex(host, "@"); i >= 0 {
+			jump.Username, host = host[:i], host[i+1:]
+		}
+		if h, port, err := net.SplitHostPort(host); err == nil {
+			host, jump.Port = h, port
+		}
+		jump.Server = strings.Trim(host, "[]")
+
+		if jump.Server == "" || jump.Username == "" {
+			return nil, fmt.Errorf("invalid proxy_host %q, expected [user@]host[:port]", spec)
+		}
+		jumps = append(jumps, jump)
+	}
+	return jumps, nil
+}
+
+// backend returns the cache of the configured backend.
+func (p *Plugin) backend() (cache.Cache, error) {
+	if p.Backend == "local" {
+		// the keys are joined to the path, relative ones would be joined
+		// to the cache directory a second time
+		path, err := filepath.Abs(p.Path)
+		if err != nil {
+			return nil, err
+		}
+		p.Path = path
+		return local.New(p.Path)
+	}
+
+	if p.InsecureIgnoreHostKey {
+		log.Println("warning: the sftp server host key is not verified")
+	}
+
+	cfg, err := p.config()
+	if err != nil {
+		return nil, err
+	}
+	return sftp.New(cfg)
+}
+
 // Exec executes the plugin.
 func (p *Plugin) Exec() error {
 	if err := p.check(); err != nil {
 		return err
 	}
 
-	sftp, err := sftp.New(
-		p.Server,
-		p.Username,
-		p.Password,
-		p.Key,
-		p.Port,
-	)
+	c, err := p.backend()
 
 	if err != nil {
 		return err
 	}
 
-	defer sftp.(io.Closer).Close()
+	if closer, ok := c.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	// the errors of every step are logged, one failing does not hide another
+	var errs []error
 
 	if p.Rebuild {
 		now := time.Now()
-		err = p.ProcessRebuild(sftp)
+		if err := p.ProcessRebuild(c); err != nil {
+			errs = append(errs, err)
+		}
 		log.Printf("cache built in %v\n", time.Since(now))
 	}
 
+	if p.Flush {
+		now := time.Now()
+		if err := p.ProcessFlush(c); err != nil {
+			errs = append(errs, err)
+		}
+		log.Printf("cache flushed in %v\n", time.Since(now))
+	}
+
 	if p.Restore {
 		// skip the restore if any case-insensitive combination of the words "skip" and "cache"
-		skipMatch := skipRe.FindString(p.Message)
-		if len(skipMatch) > 0 {
+		if skipMatch := skipRe.FindString(p.Message); len(skipMatch) > 0 {
 			log.Printf("skip restore cache. %s found in '%s'\n", skipMatch, p.Message)
-			return nil
+		} else {
+			now := time.Now()
+			if err := p.ProcessRestore(c); err != nil {
+				errs = append(errs, err)
+			}
+			log.Printf("cache restored in %v\n", time.Since(now))
 		}
-
-		now := time.Now()
-		err = p.ProcessRestore(sftp)
-		log.Printf("cache restored in %v\n", time.Since(now))
 	}
 
-	if err != nil {
+	for _, err := range errs {
 		log.Println(err)
 	}
 
@@ -94,44 +325,281 @@ func (p *Plugin) Exec() error {
 
 // ProcessRebuild rebuild the remote cache from the local environment.
 func (p Plugin) ProcessRebuild(c cache.Cache) error {
+	keys := map[string]string{}
+	rebuilt := map[string]bool{}
+
 	for _, mount := range p.Mount {
-		var hash string
-		if p.IgnoreBranch {
-			hash = hasher(mount)
-		} else {
-			hash = hasher(mount, p.Branch)
+		key, err := p.key(mount, p.Branch)
+		if err != nil {
+			return err
+		}
+		keys[mount] = key
+		rebuilt[key] = true
+	}
+
+	owner := lockOwner()
+	err := p.forEachMount(func(mount string) error {
+		path := filepath.Join(p.Path, p.Repo, keys[mount])
+
+		// the first build to lock the remote cache rebuilds it
+		if p.Lock {
+			l, err := acquireLock(c, path, owner, p.LockTimeout)
+			if e, ok := err.(*lockedError); ok {
+				log.Printf("skipping directory <%s>, %v\n", mount, e)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := l.release(); err != nil {
+					log.Printf("unable to unlock remote cache <%s>: %v\n", path, err)
+				}
+			}()
 		}
-		path := filepath.Join(p.Path, p.Repo, hash)
 
 		log.Printf("archiving directory <%s> to remote cache <%s>\n", mount, path)
 
-		err := cache.RebuildCmd(c, mount, path)
-		if err != nil {
+		if err := p.rebuild(c, mount, path); err != nil {
 			return err
 		}
+
+		// record the branch so flush can find caches of deleted branches
+		if !p.IgnoreBranch {
+			return writeBranch(c, path, p.Branch, p.TTL)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if p.Quota > 0 {
+		return p.evict(c, rebuilt)
 	}
 	return nil
 }
 
 // ProcessRestore restore the local environment from the remote cache.
 func (p Plugin) ProcessRestore(c cache.Cache) error {
-	for _, mount := range p.Mount {
-		var hash string
-		if p.IgnoreBranch {
-			hash = hasher(mount)
-		} else {
-			hash = hasher(mount, p.Branch)
+	return p.forEachMount(func(mount string) error {
+		candidates, err := p.candidates(c, mount)
+		if err != nil {
+			return err
 		}
-		path := filepath.Join(p.Path, p.Repo, hash)
+		return p.restoreFirst(c, candidates, mount)
+	})
+}
+
+// helper function to call fn for every mount, running at most parallelism
+// calls at a time. The errors of all failed mounts are combined into one.
+func (p Plugin) forEachMount(fn func(mount string) error) error {
+	parallelism := p.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallelism)
+	errs := make([]error, len(p.Mount))
 
-		log.Printf("restoring directory <%s> from remote cache <%s>\n", mount, path)
+	for i, mount := range p.Mount {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, mount string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := fn(mount); err != nil {
+				errs[i] = fmt.Errorf("directory <%s>: %v", mount, err)
+			}
+		}(i, mount)
+	}
+	wg.Wait()
+
+	return mountErrors(errs)
+}
 
-		err := cache.RestoreCmd(c, path, mount)
+// helper function to combine the errors of the mounts into one error, nil
+// errors are skipped.
+func mountErrors(errs []error) error {
+	var msgs []string
+	for _, err := range errs {
 		if err != nil {
-			return err
+			msgs = append(msgs, err.Error())
 		}
 	}
-	return nil
+
+	switch len(msgs) {
+	case 0:
+		return nil
+	case 1:
+		return errors.New(msgs[0])
+	default:
+		return fmt.Errorf("%d of %d directories failed:\n%s", len(msgs), len(errs), strings.Join(msgs, "\n"))
+	}
+}
+
+// candidate is a remote cache a mount may be restored from.
+type candidate struct {
+	path   string
+	reason string
+}
+
+// helper function to restore the mount from the first of the remote caches
+// that exists.
+func (p Plugin) restoreFirst(c cache.Cache, candidates []candidate, mount string) error {
+	for _, cand := range candidates {
+		log.Printf("restoring directory <%s> from remote cache <%s>\n", mount, cand.path)
+
+		err := p.restore(c, cand.path, mount)
+		if os.IsNotExist(err) {
+			log.Printf("remote cache <%s> not found\n", cand.path)
+			continue
+		}
+		if err == nil {
+			log.Printf("restored directory <%s> using the %s\n", mount, cand.reason)
+		}
+		return err
+	}
+	return fmt.Errorf("no remote cache found for directory <%s>", mount)
+}
+
+// helper function to return the remote caches the mount may be restored
+// from, in order of preference. The key of the branch comes first, then the
+// key of the default branch, followed by the newest remote cache of the
+// mount starting with each of the restore keys.
+func (p Plugin) candidates(c cache.Cache, mount string) ([]candidate, error) {
+	root := filepath.Join(p.Path, p.Repo)
+	seen := map[string]bool{}
+
+	var candidates []candidate
+	add := func(name, reason string) {
+		if !seen[name] {
+			seen[name] = true
+			candidates = append(candidates, candidate{filepath.Join(root, name), reason})
+		}
+	}
+
+	key, err := p.key(mount, p.Branch)
+	if err != nil {
+		return nil, err
+	}
+	add(key, fmt.Sprintf("cache of branch <%s>", p.Branch))
+
+	if p.Default != "" && p.Default != p.Branch {
+		key, err := p.key(mount, p.Default)
+		if err != nil {
+			return nil, err
+		}
+		add(key, fmt.Sprintf("cache of default branch <%s>", p.Default))
+	}
+
+	if len(p.RestoreKeys) == 0 {
+		return candidates, nil
+	}
+
+	files, err := c.List(root)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, restoreKey := range p.RestoreKeys {
+		prefix, err := renderKey(restoreKey, p.keyData(mount, p.Branch))
+		if err != nil {
+			return nil, err
+		}
+
+		if fi := newest(files, prefix, "-"+hasher(archiveFormat, mount)); fi != nil {
+			add(fi.Name(), fmt.Sprintf("newest cache matching restore key <%s>", prefix))
+		}
+	}
+	return candidates, nil
+}
+
+// archiveFormat is hashed into every remote cache name. It changes whenever
+// archives of older plugin versions can no longer be restored as they are,
+// so those are treated as misses instead. The archives of version 1 stored
+// the absolute paths of the mounts.
+const archiveFormat = "v2"
+
+// helper function to return the remote cache name of the mount for the
+// branch. Without a cache key template the name is a hash of the mount and
+// branch, otherwise the rendered template followed by a hash of the mount so
+// every mount gets its own archive.
+func (p Plugin) key(mount, branch string) (string, error) {
+	if p.CacheKey == "" {
+		if p.IgnoreBranch {
+			return hasher(archiveFormat, mount), nil
+		}
+		return hasher(archiveFormat, mount, branch), nil
+	}
+
+	key, err := renderKey(p.CacheKey, p.keyData(mount, branch))
+	if err != nil {
+		return "", err
+	}
+	return key + "-" + hasher(archiveFormat, mount), nil
+}
+
+// helper function to return the cache key template data of the mount for
+// the branch.
+func (p Plugin) keyData(mount, branch string) keyData {
+	return keyData{
+		Repo:    p.Repo,
+		Branch:  branch,
+		Default: p.Default,
+		Mount:   mount,
+	}
+}
+
+// helper function to archive src to the remote cache dst using the
+// configured engine.
+func (p Plugin) rebuild(c cache.Cache, src, dst string) error {
+	// the engine is validated by check
+	if engine, _ := cache.ParseEngine(p.Engine); engine == cache.TarEngine {
+		return cache.RebuildCmd(c, src, dst, p.options())
+	}
+	return cache.Rebuild(c, src, dst, p.options())
+}
+
+// helper function to extract the remote cache src to dst using the
+// configured engine.
+func (p Plugin) restore(c cache.Cache, src, dst string) error {
+	if engine, _ := cache.ParseEngine(p.Engine); engine == cache.TarEngine {
+		return cache.RestoreCmd(c, src, dst, p.options())
+	}
+	return cache.Restore(c, src, dst, p.options())
+}
+
+// helper function to build the archive options from the plugin settings.
+func (p Plugin) options() cache.Options {
+	// the compression is validated by check
+	compression, _ := cache.ParseCompression(p.Compression)
+
+	return cache.Options{
+		Compression: compression,
+		Level:       p.CompressionLevel,
+		MaxBytes:    p.MaxSize,
+		MaxFiles:    p.MaxFiles,
+		TTL:         p.TTL,
+	}
+}
+
+// helper function to return the most recently modified file whose name has
+// the given prefix and suffix, or nil if there is none.
+func newest(files []os.FileInfo, prefix, suffix string) os.FileInfo {
+	var found os.FileInfo
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), prefix) || !strings.HasSuffix(fi.Name(), suffix) {
+			continue
+		}
+		if found == nil || fi.ModTime().After(found.ModTime()) {
+			found = fi
+		}
+	}
+	return found
 }
 
 // helper function to hash a file name based on path and branch.
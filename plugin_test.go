@@ -1,7 +1,19 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -27,13 +39,26 @@ func TestPlugin_check(t *testing.T) {
 			},
 			true,
 		},
+		{
+			"Test agent socket",
+			Plugin{
+				Server:      "localhost",
+				Username:    "ubuntu",
+				AgentSocket: "/tmp/agent.sock",
+			},
+			false,
+		},
 	}
 	for _, tt := range tests {
 		p := &Plugin{
-			Server:   tt.fields.Server,
-			Username: tt.fields.Username,
-			Password: tt.fields.Password,
-			Key:      tt.fields.Key,
+			Server:      tt.fields.Server,
+			Username:    tt.fields.Username,
+			Password:    tt.fields.Password,
+			Key:         tt.fields.Key,
+			KeyPath:     tt.fields.KeyPath,
+			AgentSocket: tt.fields.AgentSocket,
+
+			InsecureIgnoreHostKey: true,
 		}
 		if err := p.check(); (err != nil) != tt.wantErr {
 			t.Errorf("%q. Plugin.check() error = %v, wantErr %v", tt.name, err, tt.wantErr)
@@ -57,8 +82,357 @@ func TestIncorrectPassword(t *testing.T) {
 		Username: "drone-scp",
 		Port:     "22",
 		Password: "123456",
+
+		InsecureIgnoreHostKey: true,
 	}
 
 	err := plugin.Exec()
 	assert.NotNil(t, err)
 }
+
+func TestCheckHostKey(t *testing.T) {
+	plugin := Plugin{
+		Server:   "localhost",
+		Username: "drone-scp",
+		Password: "123456",
+	}
+	assert.Error(t, plugin.check())
+
+	plugin.Fingerprints = []string{"SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8"}
+	assert.NoError(t, plugin.check())
+
+	plugin.Fingerprints = nil
+	plugin.HostCAs = []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIIv5I+Dad0XR2Fut3+u/7pN23XEE7Xi10NYKLmEMa76g host-ca"}
+	assert.NoError(t, plugin.check())
+
+	plugin.HostCAs = nil
+	plugin.InsecureIgnoreHostKey = true
+	assert.NoError(t, plugin.check())
+}
+
+func TestCheckBackend(t *testing.T) {
+	plugin := Plugin{Backend: "local", Path: "/var/lib/cache/drone"}
+	assert.NoError(t, plugin.check())
+
+	plugin.CompressionLevel = 10
+	assert.Error(t, plugin.check())
+	plugin.Compression = "zstd"
+	assert.NoError(t, plugin.check())
+	plugin.Compression = "gzip"
+	assert.Error(t, plugin.check())
+	plugin.CompressionLevel = 0
+
+	plugin.RestoreKeys = []string{"deps-"}
+	assert.Error(t, plugin.check())
+	plugin.CacheKey = "deps-{{ .Branch }}"
+	assert.NoError(t, plugin.check())
+
+	plugin.Path = ""
+	assert.Error(t, plugin.check())
+
+	plugin.Backend = "s3"
+	assert.Error(t, plugin.check())
+}
+
+func TestLocalBackend(t *testing.T) {
+	mount, err := ioutil.TempDir("", "mount")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mount)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(mount, "file"), []byte("content"), 0644))
+
+	plugin := Plugin{
+		Backend: "local",
+		Path:    t.TempDir(),
+		Repo:    "octocat/hello-world",
+		Branch:  "master",
+		Mount:   []string{mount},
+		Rebuild: true,
+		Lock:    true,
+	}
+	assert.NoError(t, plugin.Exec())
+
+	files, err := ioutil.ReadDir(filepath.Join(plugin.Path, plugin.Repo))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, files)
+
+	assert.NoError(t, os.RemoveAll(mount))
+	plugin.Rebuild = false
+	plugin.Restore = true
+	assert.NoError(t, plugin.Exec())
+
+	b, err := ioutil.ReadFile(filepath.Join(mount, "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(b))
+}
+
+func TestLocalBackendRelativePath(t *testing.T) {
+	mount := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(mount, "file"), []byte("content"), 0644))
+
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	assert.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	plugin := Plugin{
+		Backend: "local",
+		Path:    "cache",
+		Repo:    "octocat/hello-world",
+		Branch:  "master",
+		Mount:   []string{mount},
+		Rebuild: true,
+	}
+	assert.NoError(t, plugin.Exec())
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "cache", "octocat", "hello-world"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, files)
+	_, err = os.Stat(filepath.Join(dir, "cache", "cache"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestJumps(t *testing.T) {
+	plugin := Plugin{
+		Server:        "cache.internal",
+		Port:          "2222",
+		Username:      "drone",
+		Key:           "server key",
+		ProxyHost:     "bastion.example.com, admin@[2001:db8::1]:2200",
+		ProxyPort:     "22",
+		ProxyUsername: "jump",
+		KnownHosts:    "known hosts",
+	}
+
+	cfg, err := plugin.config()
+	assert.NoError(t, err)
+	if assert.Len(t, cfg.Jumps, 2) {
+		assert.Equal(t, "bastion.example.com", cfg.Jumps[0].Server)
+		assert.Equal(t, "22", cfg.Jumps[0].Port)
+		assert.Equal(t, "jump", cfg.Jumps[0].Username)
+		assert.Equal(t, "server key", cfg.Jumps[0].Key)
+		assert.Equal(t, "known hosts", cfg.Jumps[0].KnownHosts)
+
+		assert.Equal(t, "2001:db8::1", cfg.Jumps[1].Server)
+		assert.Equal(t, "2200", cfg.Jumps[1].Port)
+		assert.Equal(t, "admin", cfg.Jumps[1].Username)
+	}
+
+	// the proxy credentials replace the ones of the server
+	plugin.ProxyPassword = "secret"
+	cfg, err = plugin.config()
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", cfg.Jumps[0].Password)
+	assert.Equal(t, "", cfg.Jumps[0].Key)
+
+	plugin.ProxyHost = "user@"
+	_, err = plugin.config()
+	assert.Error(t, err)
+}
+
+// fakeCache is an in-memory implementation of the cache.Cache.
+type fakeCache struct {
+	files map[string]fakeFile
+}
+
+type fakeFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func (f fakeFile) info(name string) os.FileInfo {
+	return fakeInfo{name: name, size: int64(len(f.data)), modTime: f.modTime}
+}
+
+type fakeInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi fakeInfo) Name() string       { return fi.name }
+func (fi fakeInfo) Size() int64        { return fi.size }
+func (fi fakeInfo) Mode() os.FileMode  { return 0644 }
+func (fi fakeInfo) ModTime() time.Time { return fi.modTime }
+func (fi fakeInfo) IsDir() bool        { return false }
+func (fi fakeInfo) Sys() interface{}   { return nil }
+
+func newFakeCache() *fakeCache {
+	return &fakeCache{files: map[string]fakeFile{}}
+}
+
+func (c *fakeCache) List(root string) ([]os.FileInfo, error) {
+	var files []os.FileInfo
+	for p, f := range c.files {
+		if strings.HasPrefix(p, root+"/") {
+			files = append(files, f.info(path.Base(p)))
+		}
+	}
+	return files, nil
+}
+
+func (c *fakeCache) Get(p string) (io.ReadCloser, error) {
+	f, ok := c.files[p]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+func (c *fakeCache) Put(p string, t time.Duration, src io.Reader) error {
+	b, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	c.files[p] = fakeFile{data: b, modTime: time.Now()}
+	return nil
+}
+
+func (c *fakeCache) Create(p string, t time.Duration, src io.Reader) error {
+	if _, ok := c.files[p]; ok {
+		return os.ErrExist
+	}
+	return c.Put(p, t, src)
+}
+
+func (c *fakeCache) Remove(p string) error {
+	delete(c.files, p)
+	return nil
+}
+
+// helper function to store an archive of a single file at p.
+func (c *fakeCache) archive(t *testing.T, p, name, content string, modTime time.Time) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write([]byte(content))
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+	c.files[p] = fakeFile{data: buf.Bytes(), modTime: modTime}
+}
+
+func TestProcessRestoreKeys(t *testing.T) {
+	mount, err := ioutil.TempDir("", "mount")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mount)
+
+	p := Plugin{
+		Path:        "/cache",
+		Repo:        "octocat/hello-world",
+		Branch:      "feature",
+		Mount:       []string{mount},
+		CacheKey:    "deps-{{ .Branch }}-v2",
+		RestoreKeys: []string{"deps-{{ .Branch }}-", "deps-"},
+	}
+	suffix := "-" + hasher(archiveFormat, mount)
+	root := "/cache/octocat/hello-world/"
+	now := time.Now()
+
+	c := newFakeCache()
+	c.archive(t, root+"deps-master-v1"+suffix, "file", "master v1", now.Add(-2*time.Hour))
+	c.archive(t, root+"deps-master-v2"+suffix, "file", "master v2", now.Add(-time.Hour))
+	c.archive(t, root+"deps-other-v3-"+hasher(archiveFormat, "other"), "file", "other mount", now)
+
+	// the newest entry matching the last prefix
+	assert.NoError(t, p.ProcessRestore(c))
+	b, err := ioutil.ReadFile(filepath.Join(mount, "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "master v2", string(b))
+
+	// the first matching prefix wins over newer entries
+	c.archive(t, root+"deps-feature-v1"+suffix, "file", "feature v1", now.Add(-3*time.Hour))
+	assert.NoError(t, p.ProcessRestore(c))
+	b, err = ioutil.ReadFile(filepath.Join(mount, "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "feature v1", string(b))
+
+	// the exact key wins over all restore keys
+	c.archive(t, root+"deps-feature-v2"+suffix, "file", "feature v2", now.Add(-4*time.Hour))
+	assert.NoError(t, p.ProcessRestore(c))
+	b, err = ioutil.ReadFile(filepath.Join(mount, "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "feature v2", string(b))
+
+	// nothing matches
+	p.RestoreKeys = []string{"unknown-"}
+	p.CacheKey = "missing"
+	assert.Error(t, p.ProcessRestore(c))
+}
+
+func TestProcessRestoreDefaultBranch(t *testing.T) {
+	mount, err := ioutil.TempDir("", "mount")
+	assert.NoError(t, err)
+	defer os.RemoveAll(mount)
+
+	p := Plugin{
+		Path:    "/cache",
+		Repo:    "octocat/hello-world",
+		Branch:  "feature",
+		Default: "master",
+		Mount:   []string{mount},
+	}
+	root := "/cache/octocat/hello-world/"
+
+	c := newFakeCache()
+	c.archive(t, root+hasher(archiveFormat, mount, "master"), "file", "master", time.Now())
+
+	assert.NoError(t, p.ProcessRestore(c))
+	b, err := ioutil.ReadFile(filepath.Join(mount, "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "master", string(b))
+
+	c.archive(t, root+hasher(archiveFormat, mount, "feature"), "file", "feature", time.Now())
+	assert.NoError(t, p.ProcessRestore(c))
+	b, err = ioutil.ReadFile(filepath.Join(mount, "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "feature", string(b))
+}
+
+func TestForEachMount(t *testing.T) {
+	p := Plugin{
+		Mount:       []string{"a", "b", "c", "d", "e"},
+		Parallelism: 2,
+	}
+
+	var running, max int32
+	err := p.forEachMount(func(mount string) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		if mount == "b" || mount == "d" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	assert.Equal(t, int32(2), max)
+	assert.EqualError(t, err, "2 of 5 directories failed:\ndirectory <b>: failed\ndirectory <d>: failed")
+}
+
+func TestExecLogsEveryError(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	missing := filepath.Join(t.TempDir(), "missing")
+	plugin := Plugin{
+		Backend: "local",
+		Path:    t.TempDir(),
+		Repo:    "octocat/hello-world",
+		Branch:  "master",
+		Mount:   []string{missing},
+		Rebuild: true,
+		Flush:   true,
+	}
+	assert.NoError(t, plugin.Exec())
+
+	// the flush succeeding must not hide the failed rebuild
+	assert.Contains(t, buf.String(), missing+": no such file or directory")
+}